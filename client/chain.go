@@ -0,0 +1,153 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+// chain dials the remote server through the relays of the servers in
+// config.Chain, each hop runs its own kcp session with its own key, and
+// carries the packets of the next hop on a relay stream.
+type chain struct {
+	hops   []Config
+	blocks []kcp.BlockCrypt
+}
+
+// newChain derives the keys of the hops of config, it returns nil if no
+// chain is configured
+func newChain(config *Config) (*chain, error) {
+	hops, err := chainConfigs(config)
+	if err != nil || len(hops) == 0 {
+		return nil, err
+	}
+
+	c := &chain{hops: hops}
+	for k := range c.hops {
+		hop := &c.hops[k]
+		applyMode(hop)
+		pass, err := std.DeriveKey(hop.KDF, hop.Key, hop.KDFSalt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "chain[%v]", k)
+		}
+		hop.pass = pass
+		var block kcp.BlockCrypt
+		block, hop.Crypt = std.NewBlockCrypt(hop.Crypt, pass)
+		if hop.DirKeys {
+			block = std.NewDirectionalBlockCrypt(hop.Crypt, pass, false)
+		}
+		c.blocks = append(c.blocks, block)
+		log.Println("chain hop:", k, "remote address:", hop.RemoteAddr, "encryption:", hop.Crypt)
+	}
+	return c, nil
+}
+
+// dial dials the remote server of config with block through the hops, and
+// establishes the layers above kcp with setup.
+func (c *chain) dial(config *Config, block kcp.BlockCrypt, setup func(*kcp.UDPSession) (net.Conn, error)) (*kcp.UDPSession, net.Conn, error) {
+	var muxes []*smux.Session
+	fail := func(err error) (*kcp.UDPSession, net.Conn, error) {
+		for _, mux := range muxes {
+			mux.Close()
+		}
+		return nil, nil, err
+	}
+
+	var relay *std.RelayConn
+	for k := range c.hops {
+		hop := &c.hops[k]
+		hopSetup := func(kcpconn *kcp.UDPSession) (net.Conn, error) {
+			return setupConn(hop, nil, kcpconn)
+		}
+
+		var conn net.Conn
+		var err error
+		if relay == nil {
+			_, conn, err = dial(hop, c.blocks[k], hopSetup)
+		} else {
+			_, conn, err = dialRelayed(hop, c.blocks[k], relay, relay.RemoteAddr(), hopSetup)
+		}
+		if err != nil {
+			return fail(errors.Wrapf(err, "chain[%v]", k))
+		}
+
+		smuxConfig := smux.DefaultConfig()
+		smuxConfig.Version = hop.SmuxVer
+		smuxConfig.MaxReceiveBuffer = hop.SmuxBuf
+		smuxConfig.MaxStreamBuffer = hop.StreamBuf
+		smuxConfig.KeepAliveInterval = time.Duration(hop.KeepAlive) * time.Second
+		mux, err := smux.Client(conn, smuxConfig)
+		if err != nil {
+			conn.Close()
+			return fail(errors.Wrapf(err, "chain[%v]", k))
+		}
+		muxes = append(muxes, mux)
+
+		next := config.RemoteAddr
+		if k+1 < len(c.hops) {
+			next = c.hops[k+1].RemoteAddr
+		}
+		if relay, err = std.DialRelay(mux, next); err != nil {
+			return fail(errors.Wrapf(err, "chain[%v]", k))
+		}
+	}
+
+	kcpconn, conn, err := dialRelayed(config, block, &chainConn{relay, muxes}, relay.RemoteAddr(), setup)
+	if err != nil {
+		return fail(err)
+	}
+	log.Println("remote address:", config.RemoteAddr, "through", len(c.hops), "hops")
+	return kcpconn, conn, nil
+}
+
+// dialRelayed dials a kcp session over the relay to the next hop
+func dialRelayed(config *Config, block kcp.BlockCrypt, relay net.PacketConn, raddr net.Addr, setup func(*kcp.UDPSession) (net.Conn, error)) (*kcp.UDPSession, net.Conn, error) {
+	kcpconn, err := newConn(config, raddr, block, relay)
+	if err != nil {
+		relay.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	conn, err := setup(kcpconn)
+	return kcpconn, conn, err
+}
+
+// chainConn is the relay to the remote server, the hops are closed along
+// with the session to the remote server
+type chainConn struct {
+	*std.RelayConn
+	muxes []*smux.Session
+}
+
+func (c *chainConn) Close() error {
+	for _, mux := range c.muxes {
+		mux.Close()
+	}
+	return c.RelayConn.Close()
+}
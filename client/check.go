@@ -0,0 +1,183 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/std"
+)
+
+const (
+	// the ip and udp headers, the mtu of kcptun is the udp payload
+	ipv4UDPHeaderSize = 20 + 8
+	ipv6UDPHeaderSize = 40 + 8
+
+	// the path mtu assumed
+	pathMTU = 1500
+
+	// the headers of kcp-go within the udp payload
+	cryptHeaderSize = 16 + 4
+	fecHeaderSize   = 6 + 2
+	kcpHeaderSize   = 24
+)
+
+// linkParams are the parameters of one side of a tunnel that limit the
+// throughput, with the defaults of the flags
+type linkParams struct {
+	Crypt       string `json:"crypt"`
+	HeaderMAC   bool   `json:"headermac"`
+	MTU         int    `json:"mtu"`
+	SndWnd      int    `json:"sndwnd"`
+	RcvWnd      int    `json:"rcvwnd"`
+	DataShard   int    `json:"datashard"`
+	ParityShard int    `json:"parityshard"`
+	SmuxBuf     int    `json:"smuxbuf"`
+}
+
+// mss is the payload of a kcp segment
+func (p linkParams) mss() int {
+	mss := p.MTU - kcpHeaderSize
+	if p.Crypt != "null" {
+		mss -= cryptHeaderSize
+	}
+	if p.DataShard > 0 && p.ParityShard > 0 {
+		mss -= fecHeaderSize
+	}
+	if p.HeaderMAC {
+		mss -= std.HeaderMACSize
+	}
+	return mss
+}
+
+// checkCommand computes the throughput ceilings of a pair of configs
+func checkCommand() cli.Command {
+	return cli.Command{
+		Name:  "check",
+		Usage: "compute the throughput ceilings of a client config and its server for a round trip time, and warn about mismatches",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "c",
+				Usage: "the client config, a json file or a kcptun:// uri",
+			},
+			cli.StringFlag{
+				Name:  "server",
+				Usage: "the server config, the settings of the client with the default windows of the server if not set",
+			},
+			cli.IntFlag{
+				Name:  "rtt",
+				Value: 100,
+				Usage: "the round trip time of the path in milliseconds",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Int("rtt") <= 0 {
+				return errors.New("rtt must be positive")
+			}
+
+			// the client config is parsed the way the client does
+			config := Config{Crypt: "aes", MTU: 1350, SndWnd: 128, RcvWnd: 512, DataShard: 10, ParityShard: 3, SmuxBuf: 4194304}
+			if c.String("c") != "" {
+				if err := parseJSONConfig(&config, c.String("c")); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			client := linkParams{config.Crypt, config.HeaderMAC, config.MTU, config.SndWnd, config.RcvWnd, config.DataShard, config.ParityShard, config.SmuxBuf}
+
+			// the settings shared with the client, the default windows
+			server := client
+			server.SndWnd, server.RcvWnd, server.SmuxBuf = 1024, 1024, 4194304
+			if path := c.String("server"); path != "" {
+				f, err := os.Open(path)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				defer f.Close()
+				if err := json.NewDecoder(f).Decode(&server); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			for _, line := range checkLink(client, server, c.Int("rtt")) {
+				fmt.Println(line)
+			}
+			return nil
+		},
+	}
+}
+
+// checkLink reports the ceilings of the windows over rtt milliseconds,
+// and the warnings about the combination of client and server
+func checkLink(client, server linkParams, rtt int) (lines []string) {
+	ceiling := func(wnd, mss int) float64 { // Mbps
+		return float64(wnd*mss*8) / float64(rtt) / 1000
+	}
+	up := min(client.SndWnd, server.RcvWnd)
+	down := min(server.SndWnd, client.RcvWnd)
+	lines = append(lines,
+		fmt.Sprintf("upload ceiling: %.1f Mbps, window %v (client sndwnd %v, server rcvwnd %v), mss %v", ceiling(up, client.mss()), up, client.SndWnd, server.RcvWnd, client.mss()),
+		fmt.Sprintf("download ceiling: %.1f Mbps, window %v (server sndwnd %v, client rcvwnd %v), mss %v", ceiling(down, server.mss()), down, server.SndWnd, client.RcvWnd, server.mss()))
+	if client.DataShard > 0 && client.ParityShard > 0 {
+		lines = append(lines, fmt.Sprintf("fec overhead: %.1f%% of the packets sent", 100*float64(client.ParityShard)/float64(client.DataShard+client.ParityShard)))
+	}
+
+	warn := func(format string, v ...interface{}) {
+		lines = append(lines, "warning: "+fmt.Sprintf(format, v...))
+	}
+	if client.Crypt != server.Crypt || client.HeaderMAC != server.HeaderMAC {
+		warn("crypt or headermac differ, the sides can't talk")
+	}
+	if client.DataShard != server.DataShard || client.ParityShard != server.ParityShard {
+		warn("datashard or parityshard differ, the sides can't talk")
+	}
+	for _, side := range []struct {
+		name string
+		linkParams
+	}{{"client", client}, {"server", server}} {
+		if side.MTU+ipv4UDPHeaderSize > pathMTU {
+			warn("%v mtu %v exceeds a %v bytes path with the ipv4 and udp headers, packets are fragmented", side.name, side.MTU, pathMTU)
+		} else if side.MTU+ipv6UDPHeaderSize > pathMTU {
+			warn("%v mtu %v exceeds a %v bytes path with the ipv6 and udp headers, packets are fragmented over ipv6", side.name, side.MTU, pathMTU)
+		}
+		if side.mss() <= 0 {
+			warn("%v mtu %v leaves no room for the payload", side.name, side.MTU)
+		}
+	}
+	if client.RcvWnd < server.SndWnd {
+		warn("client rcvwnd %v is below server sndwnd %v, the download is limited by the client", client.RcvWnd, server.SndWnd)
+	}
+	if server.RcvWnd < client.SndWnd {
+		warn("server rcvwnd %v is below client sndwnd %v, the upload is limited by the server", server.RcvWnd, client.SndWnd)
+	}
+	if client.SmuxBuf < down*server.mss() {
+		warn("client smuxbuf %v is below the download window of %v bytes, the streams stall before the window fills", client.SmuxBuf, down*server.mss())
+	}
+	if server.SmuxBuf < up*client.mss() {
+		warn("server smuxbuf %v is below the upload window of %v bytes, the streams stall before the window fills", server.SmuxBuf, up*client.mss())
+	}
+	return lines
+}
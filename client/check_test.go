@@ -0,0 +1,118 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckLink(t *testing.T) {
+	client := linkParams{Crypt: "aes", MTU: 1350, SndWnd: 128, RcvWnd: 512, DataShard: 10, ParityShard: 3, SmuxBuf: 4194304}
+	server := client
+	server.SndWnd, server.RcvWnd = 1024, 1024
+	matched := linkParams{Crypt: "null", HeaderMAC: true, MTU: 1350, SndWnd: 1024, RcvWnd: 1024, SmuxBuf: 4194304}
+
+	with := func(p linkParams, f func(p *linkParams)) linkParams {
+		f(&p)
+		return p
+	}
+	for _, tc := range []struct {
+		name           string
+		client, server linkParams
+		rtt            int
+		want           []string // lines in order, warnings included
+	}{
+		{"defaults", client, server, 100, []string{
+			// mss 1350 - 24 kcp - 20 crypt - 8 fec
+			"upload ceiling: 13.3 Mbps, window 128 (client sndwnd 128, server rcvwnd 1024), mss 1298",
+			"download ceiling: 53.2 Mbps, window 512 (server sndwnd 1024, client rcvwnd 512), mss 1298",
+			"fec overhead: 23.1% of the packets sent",
+			"warning: client rcvwnd 512 is below server sndwnd 1024",
+		}},
+		{"matched windows", matched, matched, 50, []string{
+			// mss 1350 - 24 kcp - 8 headermac, no crypt nor fec header
+			"upload ceiling: 215.9 Mbps, window 1024 (client sndwnd 1024, server rcvwnd 1024), mss 1318",
+			"download ceiling: 215.9 Mbps, window 1024 (server sndwnd 1024, client rcvwnd 1024), mss 1318",
+		}},
+		{"crypt mismatch", matched, with(matched, func(p *linkParams) { p.Crypt = "aes" }), 50, []string{
+			"upload ceiling: 215.9 Mbps",
+			"download ceiling: 212.7 Mbps, window 1024 (server sndwnd 1024, client rcvwnd 1024), mss 1298",
+			"warning: crypt or headermac differ",
+		}},
+		{"headermac mismatch", matched, with(matched, func(p *linkParams) { p.HeaderMAC = false }), 50, []string{
+			"upload ceiling:",
+			"download ceiling:",
+			"warning: crypt or headermac differ",
+		}},
+		{"fec mismatch", client, with(server, func(p *linkParams) { p.ParityShard = 0 }), 100, []string{
+			"upload ceiling:",
+			"download ceiling: 53.5 Mbps, window 512 (server sndwnd 1024, client rcvwnd 512), mss 1306",
+			"fec overhead:",
+			"warning: datashard or parityshard differ",
+			"warning: client rcvwnd 512 is below server sndwnd 1024",
+		}},
+		{"ipv4 fragmentation", with(matched, func(p *linkParams) { p.MTU = 1480 }), matched, 50, []string{
+			"upload ceiling:",
+			"download ceiling:",
+			"warning: client mtu 1480 exceeds a 1500 bytes path with the ipv4 and udp headers",
+		}},
+		{"ipv6 fragmentation", matched, with(matched, func(p *linkParams) { p.MTU = 1460 }), 50, []string{
+			"upload ceiling:",
+			"download ceiling:",
+			"warning: server mtu 1460 exceeds a 1500 bytes path with the ipv6 and udp headers",
+		}},
+		{"no payload", with(matched, func(p *linkParams) { p.MTU = 32 }), matched, 50, []string{
+			"upload ceiling: 0.0 Mbps",
+			"download ceiling:",
+			"warning: client mtu 32 leaves no room for the payload",
+		}},
+		{"server rcvwnd", matched, with(matched, func(p *linkParams) { p.RcvWnd = 256 }), 50, []string{
+			"upload ceiling: 54.0 Mbps, window 256 (client sndwnd 1024, server rcvwnd 256), mss 1318",
+			"download ceiling:",
+			"warning: server rcvwnd 256 is below client sndwnd 1024",
+		}},
+		{"client smuxbuf", with(client, func(p *linkParams) { p.SmuxBuf = 65536 }), server, 100, []string{
+			"upload ceiling:",
+			"download ceiling:",
+			"fec overhead:",
+			"warning: client rcvwnd 512 is below server sndwnd 1024",
+			"warning: client smuxbuf 65536 is below the download window of 664576 bytes",
+		}},
+		{"server smuxbuf", matched, with(matched, func(p *linkParams) { p.SmuxBuf = 1048576 }), 50, []string{
+			"upload ceiling:",
+			"download ceiling:",
+			"warning: server smuxbuf 1048576 is below the upload window of 1349632 bytes",
+		}},
+	} {
+		lines := checkLink(tc.client, tc.server, tc.rtt)
+		if len(lines) != len(tc.want) {
+			t.Fatalf("%v: got %q, want %q", tc.name, lines, tc.want)
+		}
+		for k := range lines {
+			if !strings.HasPrefix(lines[k], tc.want[k]) {
+				t.Fatalf("%v: line %v is %q, want %q", tc.name, k, lines[k], tc.want[k])
+			}
+		}
+	}
+}
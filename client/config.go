@@ -25,21 +25,41 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
 )
 
 // Config for client
 type Config struct {
 	LocalAddr    string `json:"localaddr"`
 	RemoteAddr   string `json:"remoteaddr"`
+	IPFamily     string `json:"ipfamily"`
+	HopInterval  int    `json:"hopinterval"`
+	RacePorts    bool   `json:"raceports"`
+	Stdio        bool   `json:"stdio"`
 	Key          string `json:"key"`
+	KeySource    string `json:"keysource"`
 	Crypt        string `json:"crypt"`
+	KDF          string `json:"kdf"`
+	KDFSalt      string `json:"kdfsalt"`
+	DirKeys      bool   `json:"dirkeys"`
+	HeaderMAC    bool   `json:"headermac"`
+	Obfs         string `json:"obfs"`
+	KeyRotate    int    `json:"keyrotate"`
 	Mode         string `json:"mode"`
+	Profile      string `json:"profile"`
 	Conn         int    `json:"conn"`
 	AutoExpire   int    `json:"autoexpire"`
 	ScavengeTTL  int    `json:"scavengettl"`
+	Warmup       bool   `json:"warmup"`
+	StateFile    string `json:"statefile"`
 	MTU          int    `json:"mtu"`
 	SndWnd       int    `json:"sndwnd"`
 	RcvWnd       int    `json:"rcvwnd"`
+	AutoTune     bool   `json:"autotune"`
+	AutoTuneMin  int    `json:"autotunemin"`
 	DataShard    int    `json:"datashard"`
 	ParityShard  int    `json:"parityshard"`
 	DSCP         int    `json:"dscp"`
@@ -54,18 +74,73 @@ type Config struct {
 	SmuxBuf      int    `json:"smuxbuf"`
 	StreamBuf    int    `json:"streambuf"`
 	KeepAlive    int    `json:"keepalive"`
+	Ping         int    `json:"ping"`
+	Control      bool   `json:"control"`
 	Log          string `json:"log"`
 	SnmpLog      string `json:"snmplog"`
 	SnmpPeriod   int    `json:"snmpperiod"`
+	StatsPeriod  int    `json:"statsperiod"`
+	MetricsPush  string `json:"metricspush"`
+	OTLP         string `json:"otlp"`
+	DiagFile     string `json:"diagfile"`
+	Health       string `json:"health"`
 	Quiet        bool   `json:"quiet"`
 	TCP          bool   `json:"tcp"`
+	Fallback     int    `json:"fallback"`
+	FallbackLoss int    `json:"fallbackloss"`
 	Pprof        bool   `json:"pprof"`
 	QPP          bool   `json:"qpp"`
 	QPPCount     int    `json:"qpp-count"`
 	CloseWait    int    `json:"closewait"`
+	AuthKey      string `json:"authkey"`
+	AuthCert     string `json:"authcert"`
+	AuthPeers    string `json:"authpeers"`
+
+	// socket options of the local TCP connections
+	TCPNoDelay   bool `json:"tcpnodelay"`
+	TCPKeepAlive int  `json:"tcpkeepalive"`
+	TCPRcvBuf    int  `json:"tcprcvbuf"`
+	TCPSndBuf    int  `json:"tcpsndbuf"`
+	TCPDSCP      int  `json:"tcpdscp"`
+
+	// stream timeouts in seconds, 0 to disable
+	StreamIdle     int `json:"streamidle"`
+	StreamLifetime int `json:"streamlifetime"`
+
+	// admission of the local connections, 0 for no limit, connections
+	// over the limits wait for up to AdmitWait milliseconds
+	MaxConns  int `json:"maxconns"`
+	ConnRate  int `json:"connrate"`
+	AdmitWait int `json:"admitwait"`
+
+	// access log of the completed streams, rotated at AccessLogSize MB
+	AccessLog     string `json:"accesslog"`
+	AccessLogSize int    `json:"accesslogsize"`
+
+	// Forwards overrides the fields above per forwarding rule, eg:
+	// [{"localaddr":":8388","crypt":"salsa20","datashard":0,"parityshard":0}]
+	Forwards []json.RawMessage `json:"forwards"`
+
+	// Chain lists the servers relaying to remoteaddr from the entry, each
+	// overrides the fields above like Forwards, eg:
+	// [{"remoteaddr":"entry:4000","key":"entry-key"},{"remoteaddr":"middle:4000","key":"middle-key"}]
+	Chain []json.RawMessage `json:"chain"`
+
+	// Profiles are named overrides of the fields above selected by Profile,
+	// a profile may inherit another, and is matched by the CIDRs of the
+	// local address if Profile is "auto", eg:
+	// {"lte":{"match":["10.0.0.0/8"],"mtu":1200,"parityshard":5},"hotel":{"inherit":"lte","sndwnd":256}}
+	Profiles map[string]json.RawMessage `json:"profiles"`
+
+	// the key derived from Key, set by runClient and newChain
+	pass []byte
 }
 
 func parseJSONConfig(config *Config, path string) error {
+	if strings.HasPrefix(path, "kcptun://") {
+		return parseURIConfig(config, path)
+	}
+
 	file, err := os.Open(path) // For read access.
 	if err != nil {
 		return err
@@ -74,3 +149,61 @@ func parseJSONConfig(config *Config, path string) error {
 
 	return json.NewDecoder(file).Decode(config)
 }
+
+// forwardConfigs expands the forwarding rules of config, every rule inherits
+// all the settings of config and overrides the fields it specifies.
+// config itself is the only rule if no forwards are given.
+func forwardConfigs(config *Config) ([]Config, error) {
+	if len(config.Forwards) == 0 {
+		return []Config{*config}, nil
+	}
+
+	rules := make([]Config, 0, len(config.Forwards))
+	for k := range config.Forwards {
+		rule := *config
+		rule.Forwards = nil
+		if err := json.Unmarshal(config.Forwards[k], &rule); err != nil {
+			return nil, errors.Wrapf(err, "forwards[%v]", k)
+		}
+		if rule.Key != config.Key { // overridden by the rule
+			key, err := std.ResolveSecret(rule.KeySource, rule.Key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "forwards[%v]", k)
+			}
+			rule.Key = key
+		}
+		rules = append(rules, rule)
+	}
+
+	// the loss watched by fallback is read from the process-wide snmp
+	// counters of kcp-go, which can't tell the rules apart
+	if len(rules) > 1 {
+		for k := range rules {
+			if rules[k].Fallback > 0 && !rules[k].TCP {
+				return nil, errors.Errorf("forwards[%v]: fallback requires a single forwarding rule", k)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// chainConfigs returns the configs of the hops in config.Chain
+func chainConfigs(config *Config) ([]Config, error) {
+	hops := make([]Config, 0, len(config.Chain))
+	for k := range config.Chain {
+		hop := *config
+		hop.Forwards, hop.Chain = nil, nil
+		if err := json.Unmarshal(config.Chain[k], &hop); err != nil {
+			return nil, errors.Wrapf(err, "chain[%v]", k)
+		}
+		if hop.Key != config.Key { // overridden by the hop
+			key, err := std.ResolveSecret(hop.KeySource, hop.Key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "chain[%v]", k)
+			}
+			hop.Key = key
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
@@ -0,0 +1,52 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestForwardConfigsFallback(t *testing.T) {
+	config := Config{Fallback: 5}
+	if _, err := forwardConfigs(&config); err != nil {
+		t.Fatal("fallback refused for a single rule:", err)
+	}
+
+	// the loss of one rule would switch another
+	config.Forwards = []json.RawMessage{json.RawMessage(`{"localaddr":":8388"}`), json.RawMessage(`{"localaddr":":8389","tcp":true}`)}
+	if _, err := forwardConfigs(&config); err == nil || !strings.Contains(err.Error(), "single forwarding rule") {
+		t.Fatal("fallback accepted with several rules:", err)
+	}
+
+	config.Fallback = 0
+	config.Forwards = append(config.Forwards, json.RawMessage(`{"localaddr":":8390","fallback":5}`))
+	if _, err := forwardConfigs(&config); err == nil {
+		t.Fatal("fallback of a rule accepted with several rules")
+	}
+	config.Forwards = config.Forwards[:2]
+	if rules, err := forwardConfigs(&config); err != nil || len(rules) != 2 {
+		t.Fatal(rules, err)
+	}
+}
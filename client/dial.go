@@ -26,7 +26,10 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"log"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	kcp "github.com/xtaci/kcp-go/v5"
@@ -34,38 +37,291 @@ import (
 	"github.com/xtaci/tcpraw"
 )
 
-// dial connects to the remote address
-func dial(config *Config, block kcp.BlockCrypt) (*kcp.UDPSession, error) {
+const (
+	// delay between the attempts to the addresses of a host, RFC 8305
+	raceDelay = 250 * time.Millisecond
+
+	// maximum time to wait for an answer from any address of a host
+	raceTimeout = 5 * time.Second
+
+	// smux NOP frame, ignored by the server but acknowledged by kcp
+	cmdNOP = 3
+
+	// the period answers to the probes are polled at
+	probePoll = 10 * time.Millisecond
+)
+
+// newConn creates a kcp session to raddr over conn with a random conversation
+// id, the packets are piped through the plugin of config.Obfs and tagged
+// if config.HeaderMAC is set
+func newConn(config *Config, raddr net.Addr, block kcp.BlockCrypt, conn net.PacketConn) (*kcp.UDPSession, error) {
+	if config.Obfs != "" {
+		obfs, err := std.NewObfsConn(conn, config.Obfs)
+		if err != nil {
+			return nil, err
+		}
+		conn = obfs
+	}
+	if config.HeaderMAC {
+		conn = std.NewHeaderMACConn(conn, config.pass)
+	}
+	var convid uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &convid)
+	return kcp.NewConn4(convid, raddr, block, config.DataShard, config.ParityShard, true, conn)
+}
+
+// dial connects to the remote address and establishes the layers above
+// kcp with setup, when the host has addresses of both ip families in dual
+// mode, the addresses are raced Happy-Eyeballs style.
+func dial(config *Config, block kcp.BlockCrypt, setup func(*kcp.UDPSession) (net.Conn, error)) (*kcp.UDPSession, net.Conn, error) {
+	// kcp over a packet transport other than udp
+	if transport, addr, ok := std.LookupTransport(config.RemoteAddr); ok {
+		conn, raddr, err := transport.Dial(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		kcpconn, err := newConn(config, raddr, block, conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, errors.WithStack(err)
+		}
+		sconn, err := setup(kcpconn)
+		return kcpconn, sconn, err
+	}
+
 	mp, err := std.ParseMultiPort(config.RemoteAddr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// generate a random port
 	var randport uint64
 	err = binary.Read(rand.Reader, binary.LittleEndian, &randport)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	remoteAddr := fmt.Sprintf("%v:%v", mp.Host, uint64(mp.MinPort)+randport%uint64(mp.MaxPort-mp.MinPort+1))
+	port := fmt.Sprint(mp.Ports[randport%uint64(len(mp.Ports))])
+	host := strings.Trim(mp.Host, "[]")
 
 	// emulate TCP connection
 	if config.TCP {
-		conn, err := tcpraw.Dial("tcp", remoteAddr)
+		conn, err := tcpraw.Dial(std.IPNetwork("tcp", config.IPFamily), net.JoinHostPort(host, port))
 		if err != nil {
-			return nil, errors.Wrap(err, "tcpraw.Dial()")
+			return nil, nil, errors.Wrap(err, "tcpraw.Dial()")
 		}
 
-		udpaddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+		udpaddr, err := net.ResolveUDPAddr(std.IPNetwork("udp", config.IPFamily), net.JoinHostPort(host, port))
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, nil, errors.WithStack(err)
 		}
 
-		var convid uint32
-		binary.Read(rand.Reader, binary.LittleEndian, &convid)
-		return kcp.NewConn4(convid, udpaddr, block, config.DataShard, config.ParityShard, true, conn)
+		kcpconn, err := newConn(config, udpaddr, block, conn)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		sconn, err := setup(kcpconn)
+		return kcpconn, sconn, err
 	}
 
-	// default UDP connection
-	return kcp.DialWithOptions(remoteAddr, block, config.DataShard, config.ParityShard)
+	ips, err := std.LookupIPFamily(host, config.IPFamily)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.HopInterval > 0 && len(mp.Ports) > 1 {
+		// the server replies from the address it was reached on, so a
+		// session hops between the ports of a single remote IP only
+		return dialHopping(config, block, setup, ips[0], mp.Ports)
+	}
+	if config.RacePorts && len(mp.Ports) > 1 {
+		// start with the random port, then the others in order
+		ports := []string{port}
+		for _, p := range mp.Ports {
+			if fmt.Sprint(p) != port {
+				ports = append(ports, fmt.Sprint(p))
+			}
+		}
+		if !std.RaceFamilies(ips) {
+			ips = ips[:1]
+		}
+		return race(config, block, setup, joinAddrs(ips, ports))
+	}
+	if len(ips) == 1 || !std.RaceFamilies(ips) {
+		if config.Fallback > 0 { // the address must answer before falling back
+			return race(config, block, setup, joinAddrs(ips[:1], []string{port}))
+		}
+
+		// default UDP connection
+		udpaddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		network := "udp4"
+		if udpaddr.IP.To4() == nil {
+			network = "udp"
+		}
+		conn, err := listenUDP(network, config.RemoteAddr)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		kcpconn, err := newConn(config, udpaddr, block, conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, errors.WithStack(err)
+		}
+		log.Println("remote family:", std.IPFamilyOf(ips[0]), "address:", kcpconn.RemoteAddr())
+		sconn, err := setup(kcpconn)
+		return kcpconn, sconn, err
+	}
+	return race(config, block, setup, joinAddrs(ips, []string{port}))
+}
+
+// joinAddrs returns the addresses of the ports on the ips, the ports of an
+// ip come before the next ip
+func joinAddrs(ips []net.IP, ports []string) []string {
+	addrs := make([]string, 0, len(ips)*len(ports))
+	for _, ip := range ips {
+		for _, port := range ports {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return addrs
+}
+
+// raceResult is the outcome of an attempt in race
+type raceResult struct {
+	kcpconn *kcp.UDPSession
+	conn    net.Conn
+	err     error
+}
+
+// race dials the addresses one by one with raceDelay, the first address
+// answering a probe wins, and the other attempts are closed.
+func race(config *Config, block kcp.BlockCrypt, setup func(*kcp.UDPSession) (net.Conn, error), addrs []string) (*kcp.UDPSession, net.Conn, error) {
+	results := make(chan raceResult, len(addrs))
+	attempt := func(addr string) {
+		kcpconn, err := dialRacer(config, block, addr)
+		if err != nil {
+			results <- raceResult{err: err}
+			return
+		}
+		conn, err := setup(kcpconn)
+		if err != nil {
+			results <- raceResult{err: err}
+			return
+		}
+
+		// probe the path with a frame ignored by smux
+		conn.Write([]byte{byte(config.SmuxVer), cmdNOP, 0, 0, 0, 0, 0, 0})
+		if answered(kcpconn, raceTimeout) {
+			results <- raceResult{kcpconn, conn, nil}
+		} else {
+			conn.Close()
+			results <- raceResult{err: errors.Errorf("no answer from %v", kcpconn.RemoteAddr())}
+		}
+	}
+
+	next := 0
+	pending := 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			go attempt(addrs[next])
+			next++
+			pending++
+			if next < len(addrs) {
+				timer.Reset(raceDelay)
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				lastErr = res.err
+				if pending == 0 && next == len(addrs) {
+					return nil, nil, lastErr
+				}
+				if pending == 0 { // start the next attempt immediately
+					timer.Reset(0)
+				}
+				continue
+			}
+
+			// close the attempts still pending
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					if res := <-results; res.err == nil {
+						res.conn.Close()
+					}
+				}
+			}(pending)
+			log.Println("remote family:", std.IPFamilyOf(res.kcpconn.RemoteAddr().(*net.UDPAddr).IP), "address:", res.kcpconn.RemoteAddr())
+			return res.kcpconn, res.conn, nil
+		}
+	}
+}
+
+// dialRacer dials a kcp session to raddr for race, on a socket of its own
+// given to kcp as is, so the batched I/O of kcp-go is kept for the winner
+func dialRacer(config *Config, block kcp.BlockCrypt, raddr string) (*kcp.UDPSession, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	network := "udp4"
+	if udpaddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := listenUDP(network, config.RemoteAddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	kcpconn, err := newConn(config, udpaddr, block, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return kcpconn, nil
+}
+
+// answered waits for the peer of kcpconn to acknowledge a segment sent,
+// which is the first update of the round trip time estimates of kcp: the
+// SRTT leaves 0, or on a link under 1ms, the RTO leaves its default.
+func answered(kcpconn *kcp.UDPSession, timeout time.Duration) bool {
+	ticker := time.NewTicker(probePoll)
+	defer ticker.Stop()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if kcpconn.GetSRTT() > 0 || kcpconn.GetRTO() != kcp.IKCP_RTO_DEF {
+			return true
+		}
+		<-ticker.C
+	}
+	return false
+}
+
+// dialHopping dials a kcp session hopping between the remote ports of ip,
+// the local port is kept as the server identifies sessions by it
+func dialHopping(config *Config, block kcp.BlockCrypt, setup func(*kcp.UDPSession) (net.Conn, error), ip net.IP, ports []uint64) (*kcp.UDPSession, net.Conn, error) {
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := listenUDP(network, config.RemoteAddr)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	hopper := std.NewPortHopper(config.Key, ports, config.HopInterval)
+	raddr := &net.UDPAddr{IP: ip, Port: int(ports[0])}
+	kcpconn, err := newConn(config, raddr, block, std.NewHoppingConn(conn, raddr, hopper))
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	log.Println("remote family:", std.IPFamilyOf(ip), "address:", ip, "hopping ports every", config.HopInterval, "seconds")
+	sconn, err := setup(kcpconn)
+	return kcpconn, sconn, err
 }
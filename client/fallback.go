@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+)
+
+// fallback selects the transport of new sessions, it switches to TCP when
+// the UDP path fails to establish or loses too many packets, and switches
+// back when UDP is reachable again. The sessions on the previous transport
+// are left to the scavenger, so the streams on them are not dropped.
+type fallback struct {
+	config *Config
+	dialer func(config *Config) (*kcp.UDPSession, net.Conn, error)
+	tcp    int32  // 1 if new sessions are dialed over TCP
+	gen    uint32 // increased on every switch
+}
+
+// newFallback creates the transport selector of config, the loss of the
+// UDP path is monitored if the fallback is enabled, and the path is probed
+// with dialer while on TCP.
+func newFallback(config *Config, dialer func(config *Config) (*kcp.UDPSession, net.Conn, error)) *fallback {
+	f := &fallback{config: config, dialer: dialer}
+	if f.enabled() {
+		go f.monitor()
+	}
+	return f
+}
+
+// enabled returns true if the fallback is in use
+func (f *fallback) enabled() bool { return f.config.Fallback > 0 && !f.config.TCP }
+
+// generation returns the number of switches so far
+func (f *fallback) generation() uint32 { return atomic.LoadUint32(&f.gen) }
+
+// switchTo changes the transport of new sessions
+func (f *fallback) switchTo(tcp bool, reason string) {
+	v := int32(0)
+	if tcp {
+		v = 1
+	}
+	if atomic.SwapInt32(&f.tcp, v) != v {
+		atomic.AddUint32(&f.gen, 1)
+		log.Println("fallback: switched to tcp:", tcp, "reason:", reason)
+	}
+}
+
+// dial dials a session with dialer over the current transport, a failed
+// UDP dial falls back to TCP at once.
+func (f *fallback) dial(dialer func(config *Config) (*kcp.UDPSession, net.Conn, error)) (*kcp.UDPSession, net.Conn, error) {
+	if !f.enabled() {
+		return dialer(f.config)
+	}
+
+	if atomic.LoadInt32(&f.tcp) == 0 {
+		kcpconn, conn, err := dialer(f.config)
+		if err == nil {
+			return kcpconn, conn, nil
+		}
+		f.switchTo(true, err.Error())
+	}
+	config := *f.config
+	config.TCP = true
+	return dialer(&config)
+}
+
+// monitor watches the retransmission rate while on UDP, and probes the
+// UDP path every fallback period while on TCP.
+func (f *fallback) monitor() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lossy int
+	var lastProbe time.Time
+	meter := std.NewSnmpMeter()
+	for range ticker.C {
+		rates := meter.Rates()
+		if atomic.LoadInt32(&f.tcp) == 0 {
+			if rates.RetransRatio*100 > float64(f.config.FallbackLoss) {
+				lossy++
+			} else {
+				lossy = 0
+			}
+			if lossy >= f.config.Fallback {
+				lossy = 0
+				f.switchTo(true, "udp retransmission rate over threshold")
+			}
+			continue
+		}
+
+		if time.Since(lastProbe) < time.Duration(f.config.Fallback)*time.Second {
+			continue
+		}
+		lastProbe = time.Now()
+		_, conn, err := f.dialer(f.config)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		f.switchTo(false, "udp recovered")
+	}
+}
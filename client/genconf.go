@@ -0,0 +1,237 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	// the packet size the windows are computed for
+	genconfMTU = 1350
+
+	// the number of data shards of the generated FEC settings
+	genconfDataShard = 10
+)
+
+// genconfCommand generates a matched pair of client and server configs
+func genconfCommand() cli.Command {
+	return cli.Command{
+		Name:  "genconf",
+		Usage: "generate matched client and server configs with a random key, and the client config as a kcptun:// uri",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "remoteaddr",
+				Value: "vps:29900",
+				Usage: "the address the server listens on, as dialed by the client",
+			},
+			cli.StringFlag{
+				Name:  "localaddr",
+				Value: ":12948",
+				Usage: "the local listen address of the client",
+			},
+			cli.StringFlag{
+				Name:  "target",
+				Value: "127.0.0.1:12948",
+				Usage: "the target address of the server",
+			},
+			cli.StringFlag{
+				Name:  "crypt",
+				Value: "aes",
+				Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, xchacha20, none, null",
+			},
+			cli.IntFlag{
+				Name:  "bandwidth",
+				Value: 100,
+				Usage: "the bandwidth of the path in Mbps",
+			},
+			cli.IntFlag{
+				Name:  "rtt",
+				Value: 100,
+				Usage: "the round trip time of the path in milliseconds",
+			},
+			cli.Float64Flag{
+				Name:  "loss",
+				Value: 1,
+				Usage: "the expected packet loss of the path in percent",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			client, server, err := genconf(c.String("remoteaddr"), c.String("localaddr"), c.String("target"), c.String("crypt"),
+				c.Int("bandwidth"), c.Int("rtt"), c.Float64("loss"))
+			if err != nil {
+				return err
+			}
+
+			for _, cfg := range []struct {
+				name   string
+				config map[string]interface{}
+			}{{"server", server}, {"client", client}} {
+				out, _ := json.MarshalIndent(cfg.config, "", "  ")
+				fmt.Printf("# %v.json\n%s\n\n", cfg.name, out)
+			}
+			fmt.Printf("# client uri, for -c or a QR code\n%v\n", configURI(client))
+			return nil
+		},
+	}
+}
+
+// genconf sizes the windows for the bandwidth-delay product of the path
+// and the FEC for its loss, the server sends the bulk of the data.
+func genconf(remoteaddr, localaddr, target, crypt string, bandwidth, rtt int, loss float64) (client, server map[string]interface{}, err error) {
+	if _, _, err := net.SplitHostPort(remoteaddr); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if bandwidth <= 0 || rtt <= 0 || loss < 0 || loss >= 100 {
+		return nil, nil, errors.New("bandwidth and rtt must be positive, loss within [0, 100)")
+	}
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// the windows cover twice the bdp, rounded up to a power of 2
+	bdp := float64(bandwidth) * 1e6 / 8 * float64(rtt) / 1000
+	wnd := 1 << bits.Len(uint(2*bdp/genconfMTU))
+	down, up := max(wnd, 512), max(wnd/4, 128)
+	smuxbuf := max(4194304, 1<<bits.Len(uint(2*bdp)))
+
+	// enough parity shards to recover 3 times the expected loss of
+	// the data shards, plus one
+	parity := 0
+	if loss > 0 {
+		parity = min(int(math.Ceil(genconfDataShard*loss/100*3))+1, genconfDataShard)
+	}
+
+	common := map[string]interface{}{
+		"key":         hex.EncodeToString(key),
+		"crypt":       crypt,
+		"mode":        "fast",
+		"mtu":         genconfMTU,
+		"datashard":   genconfDataShard,
+		"parityshard": parity,
+		"smuxbuf":     smuxbuf,
+		"streambuf":   smuxbuf / 2,
+	}
+	client = map[string]interface{}{"localaddr": localaddr, "remoteaddr": remoteaddr, "sndwnd": up, "rcvwnd": down}
+	server = map[string]interface{}{"listen": remoteaddr[strings.LastIndex(remoteaddr, ":"):], "target": target, "sndwnd": down, "rcvwnd": up}
+	for k, v := range common {
+		client[k], server[k] = v, v
+	}
+	return client, server, nil
+}
+
+// configURI encodes a client config as kcptun://key@remoteaddr?field=value,
+// the fields are named as in the json config
+func configURI(config map[string]interface{}) string {
+	u := url.URL{Scheme: "kcptun", User: url.User(fmt.Sprint(config["key"])), Host: fmt.Sprint(config["remoteaddr"])}
+	q := url.Values{}
+	for k, v := range config {
+		if k != "key" && k != "remoteaddr" {
+			q.Set(k, fmt.Sprint(v))
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// uriFields are the fields a uri may set, tunnel parameters only, as a
+// shared uri must not run commands or write files
+var uriFields = map[string]func(config *Config) interface{}{
+	"localaddr":   func(config *Config) interface{} { return &config.LocalAddr },
+	"crypt":       func(config *Config) interface{} { return &config.Crypt },
+	"kdf":         func(config *Config) interface{} { return &config.KDF },
+	"kdfsalt":     func(config *Config) interface{} { return &config.KDFSalt },
+	"dirkeys":     func(config *Config) interface{} { return &config.DirKeys },
+	"headermac":   func(config *Config) interface{} { return &config.HeaderMAC },
+	"mode":        func(config *Config) interface{} { return &config.Mode },
+	"conn":        func(config *Config) interface{} { return &config.Conn },
+	"autoexpire":  func(config *Config) interface{} { return &config.AutoExpire },
+	"scavengettl": func(config *Config) interface{} { return &config.ScavengeTTL },
+	"mtu":         func(config *Config) interface{} { return &config.MTU },
+	"sndwnd":      func(config *Config) interface{} { return &config.SndWnd },
+	"rcvwnd":      func(config *Config) interface{} { return &config.RcvWnd },
+	"datashard":   func(config *Config) interface{} { return &config.DataShard },
+	"parityshard": func(config *Config) interface{} { return &config.ParityShard },
+	"dscp":        func(config *Config) interface{} { return &config.DSCP },
+	"nocomp":      func(config *Config) interface{} { return &config.NoComp },
+	"acknodelay":  func(config *Config) interface{} { return &config.AckNodelay },
+	"nodelay":     func(config *Config) interface{} { return &config.NoDelay },
+	"interval":    func(config *Config) interface{} { return &config.Interval },
+	"resend":      func(config *Config) interface{} { return &config.Resend },
+	"nc":          func(config *Config) interface{} { return &config.NoCongestion },
+	"sockbuf":     func(config *Config) interface{} { return &config.SockBuf },
+	"smuxver":     func(config *Config) interface{} { return &config.SmuxVer },
+	"smuxbuf":     func(config *Config) interface{} { return &config.SmuxBuf },
+	"streambuf":   func(config *Config) interface{} { return &config.StreamBuf },
+	"keepalive":   func(config *Config) interface{} { return &config.KeepAlive },
+}
+
+// parseURIConfig overrides the fields of config with those in a uri made
+// by configURI, fields not in uriFields are rejected.
+func parseURIConfig(config *Config, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if u.User != nil {
+		config.Key = u.User.Username()
+	}
+	if u.Host != "" {
+		config.RemoteAddr = u.Host
+	}
+
+	for k, vs := range u.Query() {
+		field, ok := uriFields[k]
+		if !ok {
+			return errors.Errorf("uri field %v not allowed", k)
+		}
+		v := vs[len(vs)-1]
+		switch p := field(config).(type) {
+		case *string:
+			*p = v
+		case *int:
+			if *p, err = strconv.Atoi(v); err != nil {
+				return errors.Wrapf(err, "uri field %v", k)
+			}
+		case *bool:
+			if *p, err = strconv.ParseBool(v); err != nil {
+				return errors.Wrapf(err, "uri field %v", k)
+			}
+		}
+	}
+	return nil
+}
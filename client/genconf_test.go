@@ -0,0 +1,85 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestURIConfigRoundTrip(t *testing.T) {
+	client, _, err := genconf("vps:29900", ":12948", "127.0.0.1:12948", "salsa20", 100, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{}
+	if err := parseURIConfig(&config, configURI(client)); err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		LocalAddr:   client["localaddr"].(string),
+		RemoteAddr:  client["remoteaddr"].(string),
+		Key:         client["key"].(string),
+		Crypt:       client["crypt"].(string),
+		Mode:        client["mode"].(string),
+		MTU:         client["mtu"].(int),
+		SndWnd:      client["sndwnd"].(int),
+		RcvWnd:      client["rcvwnd"].(int),
+		DataShard:   client["datashard"].(int),
+		ParityShard: client["parityshard"].(int),
+		SmuxBuf:     client["smuxbuf"].(int),
+		StreamBuf:   client["streambuf"].(int),
+	}
+	if config.LocalAddr != want.LocalAddr || config.RemoteAddr != want.RemoteAddr || config.Key != want.Key ||
+		config.Crypt != want.Crypt || config.Mode != want.Mode || config.MTU != want.MTU ||
+		config.SndWnd != want.SndWnd || config.RcvWnd != want.RcvWnd || config.DataShard != want.DataShard ||
+		config.ParityShard != want.ParityShard || config.SmuxBuf != want.SmuxBuf || config.StreamBuf != want.StreamBuf {
+		t.Fatalf("parsed %+v, want %+v", config, want)
+	}
+}
+
+func TestURIConfigRejected(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{"obfs=sh", "not allowed"},
+		{"keysource=exec", "not allowed"},
+		{"log=/etc/passwd", "not allowed"},
+		{"statefile=x", "not allowed"},
+		{"authkey=x", "not allowed"},
+		{"forwards=[]", "not allowed"},
+		{`mtu=1,"obfs":"sh"`, "uri field mtu"},
+		{"nocomp=maybe", "uri field nocomp"},
+	} {
+		config := Config{}
+		err := parseURIConfig(&config, "kcptun://key@vps:29900?"+tc.query)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("%v: got %v, want %v", tc.query, err, tc.err)
+		}
+		if config.Obfs != "" {
+			t.Fatalf("%v: obfs set to %v", tc.query, config.Obfs)
+		}
+	}
+}
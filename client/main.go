@@ -23,7 +23,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"log"
@@ -32,10 +31,9 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -46,8 +44,6 @@ import (
 )
 
 const (
-	// SALT is use for pbkdf2 key expansion
-	SALT = "kcp-go"
 	// maximum supported smux version
 	maxSmuxVer = 2
 	// scavenger check period
@@ -78,22 +74,79 @@ func main() {
 			Value: "vps:29900",
 			Usage: `kcp server address, eg: "IP:29900" a for single port, "IP:minport-maxport" for port range`,
 		},
+		cli.IntFlag{
+			Name:  "hopinterval",
+			Value: 0, // disabled
+			Usage: "hop between the ports of a multiport remote address every N seconds, on the first resolved IP and keeping the local port, the server must listen with -mergeports, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "raceports",
+			Usage: "dial all the ports of a multiport remote address, staggered by 250ms, and keep the first to answer",
+		},
+		cli.BoolFlag{
+			Name:  "stdio",
+			Usage: "forward stdin and stdout through a single stream instead of listening on localaddr, e.g. as a ProxyCommand of ssh",
+		},
+		cli.StringFlag{
+			Name:  "ipfamily",
+			Value: "",
+			Usage: "ip family: dual, prefer-ipv4, prefer-ipv6, ipv4, ipv6, empty for the system default",
+		},
 		cli.StringFlag{
 			Name:   "key",
 			Value:  "it's a secrect",
-			Usage:  "pre-shared secret between client and server",
+			Usage:  "pre-shared secret between client and server, or a reference to it in -keysource",
 			EnvVar: "KCPTUN_KEY",
 		},
+		cli.StringFlag{
+			Name:  "keysource",
+			Value: "", // the key itself
+			Usage: "where the key is read from, with -key as the reference: env for an environment variable, file, fd for a file descriptor, or exec for the output of a command",
+		},
 		cli.StringFlag{
 			Name:  "crypt",
 			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			Usage: "aes, aes-128, aes-192, salsa20, xchacha20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+		},
+		cli.StringFlag{
+			Name:  "kdf",
+			Value: "pbkdf2",
+			Usage: "key derivation function: pbkdf2, argon2id, pbkdf2-sm3",
+		},
+		cli.StringFlag{
+			Name:   "kdfsalt",
+			Value:  "",
+			Usage:  "per-deployment salt for key derivation, must be identical on both sides",
+			EnvVar: "KCPTUN_KDFSALT",
+		},
+		cli.BoolFlag{
+			Name:  "headermac",
+			Usage: "tag the packets to drop forged ones before decryption, must be identical on both sides",
+		},
+		cli.StringFlag{
+			Name:  "obfs",
+			Value: "",
+			Usage: "pipe the packets through an external obfuscation plugin, the command to run with its arguments",
+		},
+		cli.BoolFlag{
+			Name:  "dirkeys",
+			Usage: "encrypt the packets of each direction with an independent key, must be identical on both sides",
+		},
+		cli.IntFlag{
+			Name:  "keyrotate",
+			Value: 0, // disabled
+			Usage: "switch to a key derived from 'key' every N seconds, 0 to disable, clocks must be synchronized, this separates the keys of the epochs but gives no forward secrecy",
 		},
 		cli.StringFlag{
 			Name:  "mode",
 			Value: "fast",
 			Usage: "profiles: fast3, fast2, fast, normal, manual",
 		},
+		cli.StringFlag{
+			Name:  "profile",
+			Value: "",
+			Usage: "apply the named profile of the config file, or 'auto' to select it by the local network",
+		},
 		cli.BoolFlag{
 			Name:  "QPP",
 			Usage: "enable Quantum Permutation Pads(QPP)",
@@ -113,6 +166,15 @@ func main() {
 			Value: 0,
 			Usage: "set auto expiration time(in seconds) for a single UDP connection, 0 to disable",
 		},
+		cli.StringFlag{
+			Name:  "statefile",
+			Value: "",
+			Usage: "remember the local ports of the connections in a file, so that the server replaces the connections of a client restarted within 30 seconds at once",
+		},
+		cli.BoolFlag{
+			Name:  "warmup",
+			Usage: "establish all the connections of -conn at startup",
+		},
 		cli.IntFlag{
 			Name:  "scavengettl",
 			Value: 600,
@@ -133,6 +195,15 @@ func main() {
 			Value: 512,
 			Usage: "set receive window size(num of packets)",
 		},
+		cli.BoolFlag{
+			Name:  "autotune",
+			Usage: "adjust the windows of every connection to the measured loss, rtt and throughput, up to sndwnd and rcvwnd",
+		},
+		cli.IntFlag{
+			Name:  "autotunemin",
+			Value: 32,
+			Usage: "the smallest window autotune may set",
+		},
 		cli.IntFlag{
 			Name:  "datashard,ds",
 			Value: 10,
@@ -180,7 +251,7 @@ func main() {
 		cli.IntFlag{
 			Name:  "sockbuf",
 			Value: 4194304, // socket buffer size in bytes
-			Usage: "per-socket buffer in bytes",
+			Usage: "per-socket buffer in bytes, 0 to size it from the windows",
 		},
 		cli.IntFlag{
 			Name:  "smuxver",
@@ -207,6 +278,64 @@ func main() {
 			Value: 0,
 			Usage: "the seconds to wait before tearing down a connection",
 		},
+		cli.BoolTFlag{
+			Name:  "tcpnodelay",
+			Usage: "set TCP_NODELAY on the local TCP connections, true by default",
+		},
+		cli.IntFlag{
+			Name:  "tcpkeepalive",
+			Value: 0, // system default
+			Usage: "keepalive interval of the local TCP connections in seconds, 0 for the system default, -1 to disable",
+		},
+		cli.IntFlag{
+			Name:  "tcprcvbuf",
+			Value: 0, // system default
+			Usage: "SO_RCVBUF of the local TCP connections in bytes, 0 for the system default",
+		},
+		cli.IntFlag{
+			Name:  "tcpsndbuf",
+			Value: 0, // system default
+			Usage: "SO_SNDBUF of the local TCP connections in bytes, 0 for the system default",
+		},
+		cli.IntFlag{
+			Name:  "tcpdscp",
+			Value: 0, // system default
+			Usage: "DSCP(6bit) of the local TCP connections, 0 for the system default",
+		},
+		cli.IntFlag{
+			Name:  "ping",
+			Value: 0, // disabled
+			Usage: "probe the round trip time of each connection every N seconds, and reconnect if the probes are lost, 0 to disable, requires -control",
+		},
+		cli.BoolFlag{
+			Name:  "control",
+			Usage: "open a control stream first on every connection, for -ping, must be the same on both sides",
+		},
+		cli.IntFlag{
+			Name:  "streamidle",
+			Value: 0, // disabled
+			Usage: "close a stream without data in either direction for N seconds, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "streamlifetime",
+			Value: 0, // disabled
+			Usage: "close a stream N seconds after opened, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "maxconns",
+			Value: 0,
+			Usage: "admit at most N concurrent local connections, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "connrate",
+			Value: 0,
+			Usage: "admit at most N new local connections per second, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "admitwait",
+			Value: 0,
+			Usage: "wait for up to N milliseconds for the limits of admission before rejecting, 0 to reject immediately",
+		},
 		cli.StringFlag{
 			Name:  "snmplog",
 			Value: "",
@@ -217,6 +346,41 @@ func main() {
 			Value: 60,
 			Usage: "snmp collect period, in seconds",
 		},
+		cli.IntFlag{
+			Name:  "statsperiod",
+			Value: 0,
+			Usage: "log a summary of the throughput, streams, retransmissions and FEC recoveries every N seconds, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "accesslog",
+			Value: "",
+			Usage: "append a json line for every completed stream to this file",
+		},
+		cli.IntFlag{
+			Name:  "accesslogsize",
+			Value: 100,
+			Usage: "rotate the access log once it exceeds N megabytes, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "otlp",
+			Value: "",
+			Usage: "trace the stream lifecycles to an OpenTelemetry collector at the OTLP/HTTP endpoint, eg: http://localhost:4318",
+		},
+		cli.StringFlag{
+			Name:  "metricspush",
+			Value: "",
+			Usage: "push the snmp metrics every snmpperiod to statsd://host:port, influx://host:port or an InfluxDB http(s) write url",
+		},
+		cli.StringFlag{
+			Name:  "diagfile",
+			Value: "",
+			Usage: "append the diagnostic snapshots on SIGUSR1 to this file instead of the log",
+		},
+		cli.StringFlag{
+			Name:  "health",
+			Value: "",
+			Usage: "serve the tunnel health as json on this tcp address or unix socket path, eg: 127.0.0.1:12949",
+		},
 		cli.StringFlag{
 			Name:  "log",
 			Value: "",
@@ -230,29 +394,71 @@ func main() {
 			Name:  "tcp",
 			Usage: "to emulate a TCP connection(linux)",
 		},
+		cli.IntFlag{
+			Name:  "fallback",
+			Value: 0, // disabled
+			Usage: "fall back to the emulated TCP if UDP fails, or retransmits over -fallbackloss percent for N seconds, the server must run with -tcp, not with several forwarding rules, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "fallbackloss",
+			Value: 30,
+			Usage: "retransmission rate in percent considered lossy by -fallback",
+		},
+		cli.StringFlag{
+			Name:  "authkey",
+			Value: "",
+			Usage: "ed25519 private key(PEM) to enable mutual authentication",
+		},
+		cli.StringFlag{
+			Name:  "authcert",
+			Value: "",
+			Usage: "certificate(PEM) of the authkey issued by a CA, optional",
+		},
+		cli.StringFlag{
+			Name:  "authpeers",
+			Value: "",
+			Usage: "trusted public keys and CA certificates(PEM) of the peers",
+		},
 		cli.StringFlag{
 			Name:  "c",
 			Value: "", // when the value is not empty, the config path must exists
-			Usage: "config from json file, which will override the command from shell",
+			Usage: "config from json file or a kcptun:// uri, which will override the command from shell",
 		},
 		cli.BoolFlag{
 			Name:  "pprof",
 			Usage: "start profiling server on :6060",
 		},
 	}
+	myApp.Commands = []cli.Command{genconfCommand(), checkCommand()}
 	myApp.Action = func(c *cli.Context) error {
 		config := Config{}
 		config.LocalAddr = c.String("localaddr")
 		config.RemoteAddr = c.String("remoteaddr")
+		config.IPFamily = c.String("ipfamily")
+		config.HopInterval = c.Int("hopinterval")
+		config.RacePorts = c.Bool("raceports")
+		config.Stdio = c.Bool("stdio")
 		config.Key = c.String("key")
+		config.KeySource = c.String("keysource")
 		config.Crypt = c.String("crypt")
+		config.KDF = c.String("kdf")
+		config.KDFSalt = c.String("kdfsalt")
+		config.DirKeys = c.Bool("dirkeys")
+		config.HeaderMAC = c.Bool("headermac")
+		config.Obfs = c.String("obfs")
+		config.KeyRotate = c.Int("keyrotate")
 		config.Mode = c.String("mode")
+		config.Profile = c.String("profile")
 		config.Conn = c.Int("conn")
 		config.AutoExpire = c.Int("autoexpire")
 		config.ScavengeTTL = c.Int("scavengettl")
+		config.Warmup = c.Bool("warmup")
+		config.StateFile = c.String("statefile")
 		config.MTU = c.Int("mtu")
 		config.SndWnd = c.Int("sndwnd")
 		config.RcvWnd = c.Int("rcvwnd")
+		config.AutoTune = c.Bool("autotune")
+		config.AutoTuneMin = c.Int("autotunemin")
 		config.DataShard = c.Int("datashard")
 		config.ParityShard = c.Int("parityshard")
 		config.DSCP = c.Int("dscp")
@@ -270,18 +476,47 @@ func main() {
 		config.Log = c.String("log")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
+		config.StatsPeriod = c.Int("statsperiod")
+		config.MetricsPush = c.String("metricspush")
+		config.OTLP = c.String("otlp")
+		config.AccessLog = c.String("accesslog")
+		config.AccessLogSize = c.Int("accesslogsize")
+		config.DiagFile = c.String("diagfile")
+		config.Health = c.String("health")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
+		config.Fallback = c.Int("fallback")
+		config.FallbackLoss = c.Int("fallbackloss")
 		config.Pprof = c.Bool("pprof")
 		config.QPP = c.Bool("QPP")
 		config.QPPCount = c.Int("QPPCount")
 		config.CloseWait = c.Int("closewait")
+		config.TCPNoDelay = c.BoolT("tcpnodelay")
+		config.TCPKeepAlive = c.Int("tcpkeepalive")
+		config.TCPRcvBuf = c.Int("tcprcvbuf")
+		config.TCPSndBuf = c.Int("tcpsndbuf")
+		config.TCPDSCP = c.Int("tcpdscp")
+		config.Ping = c.Int("ping")
+		config.Control = c.Bool("control")
+		config.StreamIdle = c.Int("streamidle")
+		config.StreamLifetime = c.Int("streamlifetime")
+		config.MaxConns = c.Int("maxconns")
+		config.ConnRate = c.Int("connrate")
+		config.AdmitWait = c.Int("admitwait")
+		config.AuthKey = c.String("authkey")
+		config.AuthCert = c.String("authcert")
+		config.AuthPeers = c.String("authpeers")
 
 		if c.String("c") != "" {
 			err := parseJSONConfig(&config, c.String("c"))
 			checkError(err)
 		}
 
+		// secrets from external sources
+		key, err := std.ResolveSecret(config.KeySource, config.Key)
+		checkError(err)
+		config.Key = key
+
 		// log redirect
 		if config.Log != "" {
 			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -290,252 +525,526 @@ func main() {
 			log.SetOutput(f)
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		log.Println("version:", VERSION)
+
+		// network profiles override the base config
+		checkError(applyProfile(&config))
+
+		// start snmp logger
+		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+		go std.StatsLogger(config.StatsPeriod)
+		go std.MetricsPusher(config.MetricsPush, "client", config.SnmpPeriod)
+
+		// diagnostic snapshots on SIGUSR1
+		std.SetDiagFile(config.DiagFile)
+
+		// tunnel health for local applications, and the probes of
+		// orchestrators, ready once a session is established
+		std.SetReadyOnSession(true)
+		if config.Health != "" {
+			checkError(std.ServeHealth(config.Health))
+		}
+
+		// start pprof
+		if config.Pprof {
+			go http.ListenAndServe(":6060", nil)
 		}
 
-		log.Println("version:", VERSION)
-		var listener net.Listener
-		var isUnix bool
-		if _, _, err := net.SplitHostPort(config.LocalAddr); err != nil {
-			isUnix = true
+		// the local ports of the previous run
+		if config.StateFile != "" {
+			pins = loadPortPins(config.StateFile)
 		}
-		if isUnix {
-			addr, err := net.ResolveUnixAddr("unix", config.LocalAddr)
-			checkError(err)
-			listener, err = net.ListenUnix("unix", addr)
-			checkError(err)
-		} else {
-			addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
-			checkError(err)
-			listener, err = net.ListenTCP("tcp", addr)
+
+		// expand forwarding rules
+		rules, err := forwardConfigs(&config)
+		checkError(err)
+
+		checkError(runRules(rules))
+		return nil
+	}
+	myApp.Run(os.Args)
+}
+
+// runRules runs the forwarding rules until all of them stop, a rule
+// rejected by the server stops alone, the others go on
+func runRules(rules []Config) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rejection error
+	for k := range rules {
+		wg.Add(1)
+		go func(config *Config) {
+			defer wg.Done()
+			err := runClient(config)
+			var rejected *std.AuthRejectedError
+			if errors.As(err, &rejected) {
+				log.Println("rule stopped:", config.LocalAddr, err)
+				mu.Lock()
+				rejection = err
+				mu.Unlock()
+				return
+			}
 			checkError(err)
+		}(&rules[k])
+	}
+	wg.Wait()
+	return rejection
+}
+
+// runClient starts a client instance for a single forwarding rule
+func runClient(config *Config) error {
+	applyMode(config)
+
+	var listener net.Listener
+	var isUnix bool
+	if _, _, err := net.SplitHostPort(config.LocalAddr); err != nil {
+		isUnix = true
+	}
+	if config.Stdio {
+		// a single stream on stdin and stdout
+	} else if isUnix {
+		addr, err := net.ResolveUnixAddr("unix", config.LocalAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		listener, err = net.ListenUnix("unix", addr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
+		if err != nil {
+			return errors.WithStack(err)
 		}
+		listener, err = net.ListenTCP("tcp", addr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 
-		log.Println("smux version:", config.SmuxVer)
+	log.Println("smux version:", config.SmuxVer)
+	if config.Stdio {
+		log.Println("listening on: stdio")
+	} else {
 		log.Println("listening on:", listener.Addr())
-		log.Println("encryption:", config.Crypt)
-		log.Println("QPP:", config.QPP)
-		log.Println("QPP Count:", config.QPPCount)
-		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-		log.Println("remote address:", config.RemoteAddr)
-		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("compression:", !config.NoComp)
-		log.Println("mtu:", config.MTU)
-		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
-		log.Println("acknodelay:", config.AckNodelay)
-		log.Println("dscp:", config.DSCP)
-		log.Println("sockbuf:", config.SockBuf)
-		log.Println("smuxbuf:", config.SmuxBuf)
-		log.Println("streambuf:", config.StreamBuf)
-		log.Println("keepalive:", config.KeepAlive)
-		log.Println("conn:", config.Conn)
-		log.Println("autoexpire:", config.AutoExpire)
-		log.Println("scavengettl:", config.ScavengeTTL)
-		log.Println("snmplog:", config.SnmpLog)
-		log.Println("snmpperiod:", config.SnmpPeriod)
-		log.Println("quiet:", config.Quiet)
-		log.Println("tcp:", config.TCP)
-		log.Println("pprof:", config.Pprof)
-
-		// QPP parameters check
-		if config.QPP {
-			minSeedLength := qpp.QPPMinimumSeedLength(8)
-			if len(config.Key) < minSeedLength {
-				color.Red("QPP Warning: 'key' has size of %d bytes, required %d bytes at least", len(config.Key), minSeedLength)
-			}
+	}
+	log.Println("profile:", config.Profile)
+	log.Println("encryption:", config.Crypt)
+	log.Println("kdf:", config.KDF)
+	log.Println("dirkeys:", config.DirKeys)
+	log.Println("headermac:", config.HeaderMAC)
+	log.Println("obfs:", config.Obfs)
+	log.Println("QPP:", config.QPP)
+	log.Println("QPP Count:", config.QPPCount)
+	log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+	log.Println("remote address:", config.RemoteAddr)
+	log.Println("ipfamily:", config.IPFamily)
+	log.Println("hopinterval:", config.HopInterval)
+	log.Println("raceports:", config.RacePorts)
+	log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
+	log.Println("autotune:", config.AutoTune, "autotunemin:", config.AutoTuneMin)
+	log.Println("compression:", !config.NoComp)
+	log.Println("mtu:", config.MTU)
+	log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+	log.Println("acknodelay:", config.AckNodelay)
+	log.Println("dscp:", config.DSCP)
+	if config.SockBuf == 0 { // sized from the windows
+		config.SockBuf = std.AutoSockBuf(config.SndWnd, config.RcvWnd, config.MTU)
+	}
+	log.Println("sockbuf:", config.SockBuf)
+	log.Println("smuxbuf:", config.SmuxBuf)
+	log.Println("streambuf:", config.StreamBuf)
+	log.Println("keepalive:", config.KeepAlive)
+	log.Println("ping:", config.Ping)
+	log.Println("control:", config.Control)
+	log.Println("tcpnodelay:", config.TCPNoDelay, "tcpkeepalive:", config.TCPKeepAlive, "tcprcvbuf:", config.TCPRcvBuf, "tcpsndbuf:", config.TCPSndBuf, "tcpdscp:", config.TCPDSCP)
+	log.Println("streamidle:", config.StreamIdle, "streamlifetime:", config.StreamLifetime)
+	log.Println("maxconns:", config.MaxConns, "connrate:", config.ConnRate, "admitwait:", config.AdmitWait)
+	log.Println("conn:", config.Conn)
+	log.Println("warmup:", config.Warmup)
+	log.Println("statefile:", config.StateFile)
+	log.Println("autoexpire:", config.AutoExpire)
+	log.Println("keyrotate:", config.KeyRotate)
+	log.Println("scavengettl:", config.ScavengeTTL)
+	log.Println("snmplog:", config.SnmpLog)
+	log.Println("snmpperiod:", config.SnmpPeriod)
+	log.Println("statsperiod:", config.StatsPeriod)
+	log.Println("metricspush:", config.MetricsPush)
+	log.Println("otlp:", config.OTLP)
+	log.Println("accesslog:", config.AccessLog, "accesslogsize:", config.AccessLogSize)
+	log.Println("diagfile:", config.DiagFile)
+	log.Println("health:", config.Health)
+	log.Println("quiet:", config.Quiet)
+	log.Println("tcp:", config.TCP)
+	log.Println("fallback:", config.Fallback, "fallbackloss:", config.FallbackLoss)
+	log.Println("pprof:", config.Pprof)
+	log.Println("authkey:", config.AuthKey)
 
-			minPads := qpp.QPPMinimumPads(8)
-			if config.QPPCount < minPads {
-				color.Red("QPP Warning: QPPCount %d, required %d at least", config.QPPCount, minPads)
-			}
+	// QPP parameters check
+	if config.QPP {
+		minSeedLength := qpp.QPPMinimumSeedLength(8)
+		if len(config.Key) < minSeedLength {
+			color.Red("QPP Warning: 'key' has size of %d bytes, required %d bytes at least", len(config.Key), minSeedLength)
+		}
 
-			if new(big.Int).GCD(nil, nil, big.NewInt(int64(config.QPPCount)), big.NewInt(8)).Int64() != 1 {
-				color.Red("QPP Warning: QPPCount %d, choose a prime number for security", config.QPPCount)
-			}
+		minPads := qpp.QPPMinimumPads(8)
+		if config.QPPCount < minPads {
+			color.Red("QPP Warning: QPPCount %d, required %d at least", config.QPPCount, minPads)
 		}
 
-		// Scavenge parameters check
-		if config.AutoExpire != 0 && config.ScavengeTTL > config.AutoExpire {
-			color.Red("WARNING: scavengettl is bigger than autoexpire, connections may race hard to use bandwidth.")
-			color.Red("Try limiting scavengettl to a smaller value.")
+		if new(big.Int).GCD(nil, nil, big.NewInt(int64(config.QPPCount)), big.NewInt(8)).Int64() != 1 {
+			color.Red("QPP Warning: QPPCount %d, choose a prime number for security", config.QPPCount)
 		}
+	}
+
+	// KDF parameters check
+	if config.KDF == std.KDFArgon2id && config.KDFSalt == "" {
+		color.Red("KDF Warning: 'kdfsalt' is not set, choose a per-deployment salt for argon2id")
+	}
+	if limit := std.SockBufMax(); limit > 0 && config.SockBuf > limit {
+		color.Red("WARNING: sockbuf %d is capped by the kernel to %d, raise net.core.rmem_max and net.core.wmem_max", config.SockBuf, limit)
+	}
+
+	// Scavenge parameters check
+	if config.AutoExpire != 0 && config.ScavengeTTL > config.AutoExpire {
+		color.Red("WARNING: scavengettl is bigger than autoexpire, connections may race hard to use bandwidth.")
+		color.Red("Try limiting scavengettl to a smaller value.")
+	}
+	if config.KeyRotate != 0 && config.ScavengeTTL > config.KeyRotate {
+		color.Red("WARNING: scavengettl is bigger than keyrotate, expired connections may be dropped by the server.")
+		color.Red("Try limiting scavengettl to a smaller value.")
+	}
+
+	// SMUX Version check
+	if config.SmuxVer > maxSmuxVer {
+		log.Fatal("unsupported smux version:", config.SmuxVer)
+	}
 
-		// SMUX Version check
-		if config.SmuxVer > maxSmuxVer {
-			log.Fatal("unsupported smux version:", config.SmuxVer)
+	// ping streams are control streams
+	if config.Ping > 0 && !config.Control {
+		return errors.New("ping requires control")
+	}
+
+	log.Println("initiating key derivation")
+	pass, err := std.DeriveKey(config.KDF, config.Key, config.KDFSalt)
+	if err != nil {
+		return err
+	}
+	log.Println("key derivation done")
+	config.pass = pass
+	var block kcp.BlockCrypt
+	block, config.Crypt = std.NewBlockCrypt(config.Crypt, pass)
+	if config.DirKeys {
+		block = std.NewDirectionalBlockCrypt(config.Crypt, pass, false)
+	}
+
+	// keys are rotated by epochs, sessions expire at epoch boundaries
+	rotator := std.NewKeyRotator(pass, config.Crypt, config.KeyRotate)
+	if block == nil {
+		rotator = std.NewKeyRotator(pass, config.Crypt, 0)
+	}
+	if config.DirKeys {
+		rotator.SetDirectional(false)
+	}
+
+	// mutual authentication
+	var auth *std.Authenticator
+	if config.AuthKey != "" {
+		if auth, err = std.NewAuthenticator(config.AuthKey, config.AuthCert, config.AuthPeers); err != nil {
+			return err
 		}
+	}
+
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = config.SmuxVer
+	smuxConfig.MaxReceiveBuffer = config.SmuxBuf
+	smuxConfig.MaxStreamBuffer = config.StreamBuf
+	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+
+	if err := smux.VerifyConfig(smuxConfig); err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	// setup establishes the layers between kcp and smux on kcpconn
+	setup := func(kcpconn *kcp.UDPSession) (net.Conn, error) {
+		return setupConn(config, auth, kcpconn)
+	}
+
+	// the remote server may be reached through a chain of relays
+	chain, err := newChain(config)
+	if err != nil {
+		return err
+	}
 
-		log.Println("initiating key derivation")
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
-		log.Println("key derivation done")
-		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "null":
-			block = nil
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
+	// sessions are dialed with the key of an epoch
+	dialEpoch := func(config *Config, epoch int64) (*kcp.UDPSession, net.Conn, error) {
+		sessBlock := block
+		if rotator.Enabled() {
+			sessBlock = rotator.Block(epoch)
 		}
+		if chain != nil {
+			return chain.dial(config, sessBlock, setup)
+		}
+		return dial(config, sessBlock, setup)
+	}
 
-		createConn := func() (*smux.Session, error) {
-			kcpconn, err := dial(&config, block)
-			if err != nil {
-				return nil, errors.Wrap(err, "dial()")
-			}
-			kcpconn.SetStreamMode(true)
-			kcpconn.SetWriteDelay(false)
-			kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-			kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
-			kcpconn.SetMtu(config.MTU)
-			kcpconn.SetACKNoDelay(config.AckNodelay)
-
-			if err := kcpconn.SetDSCP(config.DSCP); err != nil {
-				log.Println("SetDSCP:", err)
-			}
-			if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
-				log.Println("SetReadBuffer:", err)
+	// new sessions fall back to TCP if UDP fails
+	transport := newFallback(config, func(config *Config) (*kcp.UDPSession, net.Conn, error) {
+		return dialEpoch(config, rotator.Epoch(time.Now()))
+	})
+
+	// the expiry date of a session in use from at with the key of epoch
+	expiry := func(at time.Time, epoch int64) time.Time {
+		var expiryDate time.Time
+		if config.AutoExpire > 0 {
+			expiryDate = at.Add(time.Duration(config.AutoExpire) * time.Second)
+		}
+		if rotator.Enabled() { // the session key expires at the next epoch
+			boundary := rotator.Boundary(epoch + 1)
+			if expiryDate.IsZero() || boundary.Before(expiryDate) {
+				expiryDate = boundary
 			}
-			if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
-				log.Println("SetWriteBuffer:", err)
+		}
+		return expiryDate
+	}
+
+	// createConn dials a session to be in use from at, with the key of the
+	// epoch at that time, and returns its expiry date
+	createConn := func(at time.Time) (*smux.Session, time.Time, error) {
+		epoch := rotator.Epoch(at)
+		kcpconn, conn, err := transport.dial(func(config *Config) (*kcp.UDPSession, net.Conn, error) {
+			return dialEpoch(config, epoch)
+		})
+		if err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "dial()")
+		}
+		log.Println("smux version:", config.SmuxVer, "on connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
+
+		// stream multiplex
+		session, err := smux.Client(conn, smuxConfig)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "createConn()")
+		}
+		std.TrackSession("client "+config.LocalAddr+" -> "+config.RemoteAddr, kcpconn, session, config.SndWnd, config.RcvWnd)
+		if chain == nil {
+			pins.track(config.RemoteAddr, kcpconn.LocalAddr(), session)
+		}
+		if config.Ping > 0 {
+			std.Ping(session, time.Duration(config.Ping)*time.Second)
+		} else if config.Control {
+			std.OpenControl(session, std.ControlNone)
+		}
+		if config.AutoTune {
+			go std.AutoTune(kcpconn, session, config.MTU, config.AutoTuneMin, config.SndWnd, config.RcvWnd)
+		}
+		return session, expiry(at, epoch), nil
+	}
+
+	// a rule rejected by the server stops, its listener is closed
+	chRejected := make(chan struct{})
+	var rejectOnce sync.Once
+	var rejection error
+
+	// wait until a connection is ready, the sessions dialed ahead are in
+	// use from at, the others from now, nil once the rule is rejected
+	waitConn := func(at time.Time) (*smux.Session, time.Time) {
+		for {
+			select {
+			case <-chRejected:
+				return nil, time.Time{}
+			default:
 			}
-			log.Println("smux version:", config.SmuxVer, "on connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
-			smuxConfig := smux.DefaultConfig()
-			smuxConfig.Version = config.SmuxVer
-			smuxConfig.MaxReceiveBuffer = config.SmuxBuf
-			smuxConfig.MaxStreamBuffer = config.StreamBuf
-			smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
-
-			if err := smux.VerifyConfig(smuxConfig); err != nil {
-				log.Fatalf("%+v", err)
+			if now := time.Now(); at.Before(now) {
+				at = now
 			}
-
-			// stream multiplex
-			var session *smux.Session
-			if config.NoComp {
-				session, err = smux.Client(kcpconn, smuxConfig)
-			} else {
-				session, err = smux.Client(std.NewCompStream(kcpconn), smuxConfig)
+			session, expiryDate, err := createConn(at)
+			if err == nil {
+				return session, expiryDate
 			}
-			if err != nil {
-				return nil, errors.Wrap(err, "createConn()")
+			// retrying can't help once the server has told so
+			var rejected *std.AuthRejectedError
+			if errors.As(err, &rejected) && rejected.Verified {
+				rejectOnce.Do(func() {
+					rejection = err
+					close(chRejected)
+					if listener != nil {
+						listener.Close()
+					}
+				})
+				return nil, time.Time{}
 			}
-			return session, nil
+			log.Println("re-connecting:", err)
+			time.Sleep(time.Second)
 		}
+	}
 
-		// wait until a connection is ready
-		waitConn := func() *smux.Session {
-			for {
-				if session, err := createConn(); err == nil {
-					return session
-				} else {
-					log.Println("re-connecting:", err)
-					time.Sleep(time.Second)
-				}
-			}
-		}
+	// start scavenger if autoexpire or keyrotate is set
+	chScavenger := make(chan timedSession, 128)
+	if config.AutoExpire > 0 || rotator.Enabled() || transport.enabled() {
+		go scavenger(chScavenger, config)
+	}
 
-		// start snmp logger
-		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+	// socket options of the accepted connections
+	tcpOptions := std.TCPOptions{NoDelay: config.TCPNoDelay, KeepAlive: config.TCPKeepAlive, ReadBuf: config.TCPRcvBuf, WriteBuf: config.TCPSndBuf, DSCP: config.TCPDSCP}
 
-		// start pprof
-		if config.Pprof {
-			go http.ListenAndServe(":6060", nil)
-		}
+	// start listener
+	pool := newSessionPool(config.Conn, waitConn, transport, chScavenger)
 
-		// start scavenger if autoexpire is set
-		chScavenger := make(chan timedSession, 128)
-		if config.AutoExpire > 0 {
-			go scavenger(chScavenger, &config)
-		}
+	// stream lifecycles are traced if an OTLP endpoint is set
+	tracer := std.NewTracer(config.OTLP, "kcptun-client")
 
-		// start listener
-		numconn := uint16(config.Conn)
-		muxes := make([]timedSession, numconn)
-		rr := uint16(0)
+	// completed streams are logged to the access log
+	access, err := std.NewAccessLog(config.AccessLog, config.AccessLogSize)
+	if err != nil {
+		return err
+	}
+
+	// create shared QPP
+	var _Q_ *qpp.QuantumPermutationPad
+	if config.QPP {
+		_Q_ = qpp.NewQPP([]byte(config.Key), uint16(config.QPPCount))
+	}
 
-		// create shared QPP
-		var _Q_ *qpp.QuantumPermutationPad
-		if config.QPP {
-			_Q_ = qpp.NewQPP([]byte(config.Key), uint16(config.QPPCount))
+	// pipe stdio through a single stream and exit
+	if config.Stdio {
+		session, _ := waitConn(time.Now())
+		if session == nil {
+			return rejection
 		}
+		handleClient(_Q_, []byte(config.Key), session, std.NewStdioConn(), tracer, access, config.Quiet, config.CloseWait, config.StreamIdle, config.StreamLifetime)
+		return session.Close()
+	}
 
-		for {
-			p1, err := listener.Accept()
-			if err != nil {
-				log.Fatalf("%+v", err)
+	if config.Warmup {
+		pool.warmup()
+	}
+
+	// the connections over the limits queue in the listen backlog
+	admit := std.NewAdmission(config.MaxConns, config.ConnRate, time.Duration(config.AdmitWait)*time.Millisecond)
+	for {
+		p1, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-chRejected:
+				return rejection
+			default:
 			}
-			idx := rr % numconn
-
-			// do auto expiration && reconnection
-			if muxes[idx].session == nil || muxes[idx].session.IsClosed() ||
-				(config.AutoExpire > 0 && time.Now().After(muxes[idx].expiryDate)) {
-				muxes[idx].session = waitConn()
-				muxes[idx].expiryDate = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-				if config.AutoExpire > 0 { // only when autoexpire set
-					chScavenger <- muxes[idx]
-				}
+			return errors.WithStack(err)
+		}
+		if !admit.Acquire() {
+			if !config.Quiet {
+				log.Println("connection rejected:", p1.RemoteAddr())
 			}
+			p1.Close()
+			continue
+		}
+		if err := tcpOptions.Apply(p1); err != nil {
+			log.Println("tcp options:", err)
+		}
+		go func() {
+			defer admit.Release()
+			session := pool.get()
+			if session == nil { // the rule is rejected
+				p1.Close()
+				return
+			}
+			handleClient(_Q_, []byte(config.Key), session, p1, tracer, access, config.Quiet, config.CloseWait, config.StreamIdle, config.StreamLifetime)
+		}()
+	}
+}
+
+// applyMode sets the kcp parameters of the preset mode of config
+func applyMode(config *Config) {
+	switch config.Mode {
+	case "normal":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
+	case "fast":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
+	case "fast2":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
+	case "fast3":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+	}
+}
+
+// setupConn applies the kcp parameters of config to kcpconn, and
+// establishes the layers between kcp and smux
+func setupConn(config *Config, auth *std.Authenticator, kcpconn *kcp.UDPSession) (net.Conn, error) {
+	kcpconn.SetStreamMode(true)
+	kcpconn.SetWriteDelay(false)
+	kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+	kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
+	mtu := config.MTU
+	if config.HeaderMAC { // room for the tag
+		mtu -= std.HeaderMACSize
+	}
+	kcpconn.SetMtu(mtu)
+	kcpconn.SetACKNoDelay(config.AckNodelay)
+
+	if err := kcpconn.SetDSCP(config.DSCP); err != nil {
+		log.Println("SetDSCP:", err)
+	}
+	if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
+	}
 
-			go handleClient(_Q_, []byte(config.Key), muxes[idx].session, p1, config.Quiet, config.CloseWait)
-			rr++
+	var conn net.Conn = kcpconn
+	if auth != nil {
+		sconn, err := auth.Client(kcpconn)
+		if err != nil {
+			kcpconn.Close()
+			return nil, errors.Wrap(err, "auth.Client()")
 		}
+		log.Println("authenticated server:", sconn.Identity(), "on connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
+		conn = sconn
 	}
-	myApp.Run(os.Args)
+
+	if !config.NoComp {
+		conn = std.NewCompStream(conn)
+	}
+	return conn, nil
 }
 
 // handleClient aggregates connection p1 on mux
-func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, session *smux.Session, p1 net.Conn, quiet bool, closeWait int) {
+func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, session *smux.Session, p1 net.Conn, tracer *std.Tracer, access *std.AccessLog, quiet bool, closeWait, idle, lifetime int) {
 	logln := func(v ...interface{}) {
 		if !quiet {
 			log.Println(v...)
 		}
 	}
 
+	// local accept -> stream open -> close
+	start := time.Now()
+	span := tracer.Start("kcptun.stream", std.SpanServer, nil)
+	span.Set("net.peer.addr", p1.RemoteAddr())
+	defer span.End()
+
 	// handles transport layer
 	defer p1.Close()
+	open := tracer.Start("smux.open", std.SpanInternal, span)
 	p2, err := session.OpenStream()
+	open.End()
 	if err != nil {
 		logln(err)
+		span.Set("kcptun.close_reason", err)
 		return
 	}
 	defer p2.Close()
+	span.Set("smux.stream", p2.ID())
 
 	logln("stream opened", "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
 	defer logln("stream closed", "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.ID(), ")"))
 
 	var s1, s2 io.ReadWriteCloser = p1, p2
+	// bytes in are sent from the local peer to the server
+	var counted *std.CountedConn
+	if tracer != nil || access != nil {
+		counted = std.NewCountedConn(p1)
+		s1 = counted
+	}
 	// if QPP is enabled, create QPP read write closer
 	if _Q_ != nil {
 		// replace s2 with QPP port
@@ -543,7 +1052,16 @@ func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, session *smux.Ses
 	}
 
 	// stream layer
-	err1, err2 := std.Pipe(s1, s2, closeWait)
+	err1, err2 := std.PipeTimeout(s1, s2, closeWait, idle, lifetime)
+	if counted != nil {
+		reason := std.CloseReason(err1, err2)
+		span.Set("kcptun.bytes_up", counted.BytesIn())
+		span.Set("kcptun.bytes_down", counted.BytesOut())
+		span.Set("kcptun.close_reason", reason)
+		span.SetSession(session)
+		access.Log(std.AccessEntry{Client: p1.RemoteAddr().String(), Target: p2.RemoteAddr().String(), Stream: p2.ID(),
+			Duration: time.Since(start).Seconds(), BytesUp: counted.BytesIn(), BytesDown: counted.BytesOut(), Reason: reason})
+	}
 
 	// handles transport layer errors
 	if err1 != nil && err1 != io.EOF {
@@ -565,9 +1083,11 @@ func checkError(err error) {
 type timedSession struct {
 	session    *smux.Session
 	expiryDate time.Time
+	gen        uint32 // the transport generation of session
 }
 
-// scavenger goroutine is used to close expired sessions
+// scavenger goroutine is used to close expired sessions, the sessions
+// are closed once their streams are drained, or after scavengettl
 func scavenger(ch chan timedSession, config *Config) {
 	ticker := time.NewTicker(scavengePeriod * time.Second)
 	defer ticker.Stop()
@@ -575,16 +1095,17 @@ func scavenger(ch chan timedSession, config *Config) {
 	for {
 		select {
 		case item := <-ch:
-			sessionList = append(sessionList, timedSession{
-				item.session,
-				item.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)})
+			sessionList = append(sessionList, item)
 		case <-ticker.C:
 			var newList []timedSession
 			for k := range sessionList {
 				s := sessionList[k]
 				if s.session.IsClosed() {
 					log.Println("scavenger: session normally closed:", s.session.LocalAddr())
-				} else if time.Now().After(s.expiryDate) {
+				} else if time.Now().After(s.expiryDate) && std.NumStreams(s.session) == 0 {
+					s.session.Close()
+					log.Println("scavenger: session closed after drained:", s.session.LocalAddr())
+				} else if time.Now().After(s.expiryDate.Add(time.Duration(config.ScavengeTTL) * time.Second)) {
 					s.session.Close()
 					log.Println("scavenger: session closed due to ttl:", s.session.LocalAddr())
 				} else {
@@ -0,0 +1,171 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+	"github.com/xtaci/smux"
+)
+
+// writeAuthKey writes an ed25519 key pair, returns the private key file
+// and the public key file
+func writeAuthKey(t *testing.T, dir, name string) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	der, _ = x509.MarshalPKIXPublicKey(pub)
+	pubFile := filepath.Join(dir, name+".pub")
+	os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	return keyFile, pubFile
+}
+
+// freeAddr returns a local tcp address not in use
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// testServer serves kcp sessions on a local port with serve
+func testServer(t *testing.T, serve func(*kcp.UDPSession)) string {
+	l, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			conn.SetStreamMode(true)
+			conn.SetWriteDelay(false)
+			conn.SetNoDelay(0, 30, 2, 1)
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRejectedRule(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	clientKey, _ := writeAuthKey(t, dir, "client")
+	serverKey, serverPub := writeAuthKey(t, dir, "server")
+	_, strangerPub := writeAuthKey(t, dir, "stranger")
+
+	// the server of the first rule trusts another client
+	serverAuth, err := std.NewAuthenticator(serverKey, "", strangerPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejecting := testServer(t, func(conn *kcp.UDPSession) {
+		defer conn.Close()
+		serverAuth.Server(conn)
+		time.Sleep(time.Second)
+	})
+
+	// the server of the second rule echoes the streams
+	echoing := testServer(t, func(conn *kcp.UDPSession) {
+		session, err := smux.Server(conn, nil)
+		if err != nil {
+			return
+		}
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go io.Copy(stream, stream)
+		}
+	})
+
+	rule := func(localaddr, remoteaddr string) Config {
+		return Config{LocalAddr: localaddr, RemoteAddr: remoteaddr, Key: "it's a secrect", Crypt: "null",
+			Mode: "fast", Conn: 1, MTU: 1350, SndWnd: 128, RcvWnd: 512, NoComp: true,
+			SmuxVer: 1, SmuxBuf: 4194304, StreamBuf: 2097152, KeepAlive: 10, Quiet: true}
+	}
+	rejected, echoed := rule(freeAddr(t), rejecting), rule(freeAddr(t), echoing)
+	rejected.AuthKey, rejected.AuthPeers = clientKey, serverPub
+	done := make(chan error, 1)
+	go func() { done <- runRules([]Config{rejected, echoed}) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// the rejected rule closes its listener
+	if conn, err := net.Dial("tcp", rejected.LocalAddr); err == nil {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", rejected.LocalAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("rejected rule still listening")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the other rule goes on
+	conn, err := net.Dial("tcp", echoed.LocalAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("rule stopped by the rejection of another:", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatal("rules returned:", err)
+	default:
+	}
+}
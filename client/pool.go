@@ -0,0 +1,175 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// sessions are dialed ahead of their expiry by renewAhead
+const renewAhead = 10 * time.Second
+
+// sessionPool round-robins the local connections over the sessions to
+// the server. Expiring sessions are replaced by sessions dialed ahead in
+// the background, so the local connections don't wait for a handshake,
+// and the expired sessions are retired by the scavenger once drained.
+// The local connections are handled concurrently, each slot is guarded
+// by its own lock, held while the slot is redialed, and the connections
+// are passed on to the next slot meanwhile.
+type sessionPool struct {
+	mu        sync.Mutex // guards rr
+	rr        int
+	slots     []poolSlot
+	ahead     []chan timedSession // the replacements dialed ahead
+	create    func(at time.Time) (*smux.Session, time.Time)
+	transport *fallback
+	retire    chan<- timedSession
+}
+
+// poolSlot is a session of the pool and the lock guarding it
+type poolSlot struct {
+	mu sync.Mutex
+	timedSession
+}
+
+// newSessionPool creates a pool of size sessions dialed by create, which
+// returns a session in use from at and its expiry date, zero if never,
+// or a nil session once the server has rejected the client.
+func newSessionPool(size int, create func(at time.Time) (*smux.Session, time.Time), transport *fallback, retire chan<- timedSession) *sessionPool {
+	p := &sessionPool{create: create, transport: transport, retire: retire}
+	p.slots = make([]poolSlot, size)
+	p.ahead = make([]chan timedSession, size)
+	for k := range p.ahead {
+		p.ahead[k] = make(chan timedSession, 1)
+	}
+	return p
+}
+
+// warmup establishes all the sessions of the pool
+func (p *sessionPool) warmup() {
+	var wg sync.WaitGroup
+	for k := range p.slots {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			var session timedSession
+			session.session, session.expiryDate = p.create(time.Now())
+			p.slots[k].mu.Lock()
+			p.assign(k, session)
+			p.slots[k].mu.Unlock()
+		}(k)
+	}
+	wg.Wait()
+	log.Println("warmup:", len(p.slots), "sessions established")
+}
+
+// get returns the next session in the pool. A slot being redialed is
+// skipped for the next one, a new session is dialed if none is available
+// in the slot, and the connections wait for it only if all the slots are
+// being redialed.
+func (p *sessionPool) get() *smux.Session {
+	p.mu.Lock()
+	idx := p.rr % len(p.slots)
+	p.rr++
+	p.mu.Unlock()
+
+	for k := range p.slots {
+		next := (idx + k) % len(p.slots)
+		if p.slots[next].mu.TryLock() {
+			defer p.slots[next].mu.Unlock()
+			return p.session(next)
+		}
+	}
+	p.slots[idx].mu.Lock()
+	defer p.slots[idx].mu.Unlock()
+	return p.session(idx)
+}
+
+// session returns the session of slot idx, dialing a new one if none is
+// available, the lock of the slot must be held
+func (p *sessionPool) session(idx int) *smux.Session {
+	s := &p.slots[idx]
+
+	// sessions on the previous transport are left to drain
+	if s.session != nil && s.gen != p.transport.generation() {
+		p.retire <- timedSession{session: s.session, expiryDate: time.Now()}
+		s.session = nil
+	}
+
+	// do auto expiration && reconnection
+	if s.session == nil || s.session.IsClosed() || expired(s.expiryDate) {
+		var next timedSession
+		select {
+		case next = <-p.ahead[idx]:
+		default:
+		}
+
+		// a replacement dialed ahead may have expired while idle
+		if next.session != nil && expired(next.expiryDate) {
+			next.session.Close()
+		}
+		if next.session == nil || next.session.IsClosed() {
+			next.session, next.expiryDate = p.create(time.Now())
+		}
+		p.assign(idx, next)
+	}
+	return s.session
+}
+
+// expired tells if an expiry date, zero if never, has passed
+func expired(expiryDate time.Time) bool {
+	return !expiryDate.IsZero() && time.Now().After(expiryDate)
+}
+
+// assign puts session into slot idx, and schedules its replacement to be
+// dialed ahead of its expiry, the lock of the slot must be held
+func (p *sessionPool) assign(idx int, session timedSession) {
+	s := &p.slots[idx]
+	s.session = session.session
+	s.gen = p.transport.generation()
+	s.expiryDate = session.expiryDate
+	if s.expiryDate.IsZero() { // only when autoexpire or keyrotate set
+		return
+	}
+	p.retire <- s.timedSession
+
+	// short lived sessions are renewed at 3/4 of their life at the latest
+	lifetime := time.Until(s.expiryDate)
+	ahead := min(renewAhead, lifetime/4)
+	expiryDate := s.expiryDate
+	time.AfterFunc(lifetime-ahead, func() {
+		var next timedSession
+		next.session, next.expiryDate = p.create(expiryDate)
+		select {
+		case p.ahead[idx] <- next:
+		default: // a replacement is pending
+			if next.session != nil {
+				next.session.Close()
+			}
+		}
+	})
+}
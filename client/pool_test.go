@@ -0,0 +1,207 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestSessionPoolConcurrentGet(t *testing.T) {
+	var dials int32
+	var mu sync.Mutex
+	var opened []*smux.Session
+	create := func(at time.Time) (*smux.Session, time.Time) {
+		atomic.AddInt32(&dials, 1)
+		c1, c2 := net.Pipe()
+		go smux.Server(c2, nil)
+		session, err := smux.Client(c1, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		opened = append(opened, session)
+		mu.Unlock()
+		return session, time.Time{}
+	}
+	transport := newFallback(&Config{}, nil)
+	pool := newSessionPool(4, create, transport, make(chan timedSession, 16))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pool.get() == nil {
+				t.Error("nil session")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&dials); n != 4 {
+		t.Fatalf("dialed %v sessions for 4 slots", n)
+	}
+
+	// a dead slot is redialed once
+	opened[0].Close()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.get()
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&dials); n != 5 {
+		t.Fatalf("dialed %v sessions after closing one", n)
+	}
+	for _, s := range opened {
+		s.Close()
+	}
+}
+
+func TestSessionPoolRenewAhead(t *testing.T) {
+	const life = 400 * time.Millisecond
+	dialed := make(chan time.Time, 4)
+	create := func(at time.Time) (*smux.Session, time.Time) {
+		dialed <- at
+		c1, c2 := net.Pipe()
+		go smux.Server(c2, nil)
+		session, _ := smux.Client(c1, nil)
+		return session, at.Add(life)
+	}
+	transport := newFallback(&Config{}, nil)
+	pool := newSessionPool(1, create, transport, make(chan timedSession, 16))
+
+	start := time.Now()
+	defer pool.get().Close()
+	first := <-dialed
+
+	// a short lived session is renewed at 3/4 of its life, for the
+	// time it expires
+	select {
+	case at := <-dialed:
+		if elapsed := time.Since(start); elapsed < life/2 {
+			t.Fatal("renewed too early:", elapsed)
+		}
+		if !at.Equal(first.Add(life)) {
+			t.Fatal("renewal not dialed for the expiry:", at.Sub(first))
+		}
+	case <-time.After(life):
+		t.Fatal("not renewed ahead")
+	}
+	(<-pool.ahead[0]).session.Close()
+}
+
+func TestSessionPoolIdlePastExpiry(t *testing.T) {
+	const life = 200 * time.Millisecond
+	var mu sync.Mutex
+	var opened []*smux.Session
+	create := func(at time.Time) (*smux.Session, time.Time) {
+		c1, c2 := net.Pipe()
+		go smux.Server(c2, nil)
+		session, _ := smux.Client(c1, nil)
+		mu.Lock()
+		opened = append(opened, session)
+		mu.Unlock()
+		return session, at.Add(life)
+	}
+	transport := newFallback(&Config{}, nil)
+	pool := newSessionPool(1, create, transport, make(chan timedSession, 16))
+	defer func() {
+		mu.Lock()
+		for _, s := range opened {
+			s.Close()
+		}
+		mu.Unlock()
+	}()
+
+	pool.get()
+
+	// idle past the expiry of the replacement dialed ahead
+	time.Sleep(3 * life)
+	mu.Lock()
+	if len(opened) != 2 {
+		t.Fatalf("%v sessions dialed, want 2", len(opened))
+	}
+	replacement := opened[1]
+	mu.Unlock()
+
+	if pool.get() == replacement {
+		t.Fatal("expired replacement installed")
+	}
+	if !replacement.IsClosed() {
+		t.Fatal("expired replacement not closed")
+	}
+}
+
+func TestSessionPoolDeadSlot(t *testing.T) {
+	release := make(chan struct{})
+	var dials int32
+	create := func(at time.Time) (*smux.Session, time.Time) {
+		if atomic.AddInt32(&dials, 1) > 2 {
+			<-release
+		}
+		c1, c2 := net.Pipe()
+		go smux.Server(c2, nil)
+		session, _ := smux.Client(c1, nil)
+		return session, time.Time{}
+	}
+	transport := newFallback(&Config{}, nil)
+	pool := newSessionPool(2, create, transport, make(chan timedSession, 16))
+	pool.warmup()
+	pool.slots[0].session.Close()
+	live := pool.slots[1].session
+
+	// the redial of slot 0 blocks, the connections go to slot 1 meanwhile
+	redialed := make(chan *smux.Session)
+	go func() { redialed <- pool.get() }()
+	for atomic.LoadInt32(&dials) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		done := make(chan *smux.Session)
+		go func() { done <- pool.get() }()
+		select {
+		case s := <-done:
+			if s != live {
+				t.Fatal("connection not passed to the live slot")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("connection stalled by the dead slot")
+		}
+	}
+
+	close(release)
+	if s := <-redialed; s == nil || s.IsClosed() {
+		t.Fatal("slot 0 not redialed")
+	}
+	for k := range pool.slots {
+		pool.slots[k].session.Close()
+	}
+}
@@ -0,0 +1,134 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
+)
+
+// profileAuto selects the profile matching the network the client is on
+const profileAuto = "auto"
+
+// profileMeta holds the fields of a profile besides the overridden config
+type profileMeta struct {
+	Inherit string   `json:"inherit"` // the profile overridden by this one
+	Match   []string `json:"match"`   // CIDRs of the local address for auto
+}
+
+// applyProfile overrides config with the profile selected by config.Profile,
+// after the profiles it inherits from.
+func applyProfile(config *Config) error {
+	name := config.Profile
+	if name == "" {
+		return nil
+	}
+	if name == profileAuto {
+		var err error
+		if name, err = matchProfile(config); err != nil {
+			return err
+		}
+		if name == "" {
+			log.Println("profile: no profile matches the network, using the base config")
+			return nil
+		}
+		log.Println("profile: auto selected:", name)
+		config.Profile = name
+	}
+
+	// the profile and its ancestors, from the nearest
+	var lineage []string
+	for seen := make(map[string]bool); name != ""; {
+		if seen[name] {
+			return errors.Errorf("profile %v: inheritance loop", name)
+		}
+		seen[name] = true
+		raw, ok := config.Profiles[name]
+		if !ok {
+			return errors.Errorf("profile %v: not found", name)
+		}
+		var meta profileMeta
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return errors.Wrapf(err, "profile %v", name)
+		}
+		lineage = append(lineage, name)
+		name = meta.Inherit
+	}
+
+	key := config.Key
+	for i := len(lineage) - 1; i >= 0; i-- {
+		if err := json.Unmarshal(config.Profiles[lineage[i]], config); err != nil {
+			return errors.Wrapf(err, "profile %v", lineage[i])
+		}
+	}
+	if config.Key != key { // overridden by the profile
+		resolved, err := std.ResolveSecret(config.KeySource, config.Key)
+		if err != nil {
+			return errors.Wrapf(err, "profile %v", lineage[0])
+		}
+		config.Key = resolved
+	}
+	return nil
+}
+
+// matchProfile probes the local address routed to remoteaddr, and returns
+// the profile with the most specific CIDR matching it
+func matchProfile(config *Config) (string, error) {
+	mp, err := std.ParseMultiPort(config.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	// connecting a UDP socket only looks up the route, nothing is sent
+	conn, err := net.Dial(std.IPNetwork("udp", config.IPFamily), net.JoinHostPort(strings.Trim(mp.Host, "[]"), "9"))
+	if err != nil {
+		return "", errors.Wrap(err, "profile: probe")
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	log.Println("profile: local address:", local)
+
+	best, bestBits := "", -1
+	for name, raw := range config.Profiles {
+		var meta profileMeta
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return "", errors.Wrapf(err, "profile %v", name)
+		}
+		for _, cidr := range meta.Match {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return "", errors.Wrapf(err, "profile %v", name)
+			}
+			bits, _ := ipnet.Mask.Size()
+			// ties are broken by name to be deterministic
+			if ipnet.Contains(local) && (bits > bestBits || bits == bestBits && name < best) {
+				best, bestBits = name, bits
+			}
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,145 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// the orphaned sessions of a previous run are assumed gone on the server
+// after resumeGrace, the smux keepalive timeout
+const resumeGrace = 30 * time.Second
+
+// portPins remembers the local ports of the sessions in a state file, so
+// that a client restarted within resumeGrace dials from the same ports,
+// and the server replaces the sessions orphaned by the restart at once,
+// rather than keeping them until they time out.
+type portPins struct {
+	path  string
+	mu    sync.Mutex
+	saved map[string][]int        // the ports of the previous run by remote address
+	live  map[string]map[int]bool // the ports in use by remote address
+}
+
+// pins is nil if the state file is not set
+var pins *portPins
+
+// loadPortPins loads the ports of the previous run from the state file
+func loadPortPins(path string) *portPins {
+	p := &portPins{path: path, saved: make(map[string][]int), live: make(map[string]map[int]bool)}
+	if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) < resumeGrace {
+		if data, err := os.ReadFile(path); err == nil {
+			if err := json.Unmarshal(data, &p.saved); err != nil {
+				log.Println("statefile:", err)
+			}
+		}
+	}
+
+	// the state file is refreshed while running, so that its age tells
+	// the time since the client stopped
+	go func() {
+		for range time.Tick(resumeGrace / 3) {
+			p.mu.Lock()
+			p.save()
+			p.mu.Unlock()
+		}
+	}()
+	return p
+}
+
+// take returns a port of the previous run for the sessions to raddr, or 0
+func (p *portPins) take(raddr string) int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ports := p.saved[raddr]
+	if len(ports) == 0 {
+		return 0
+	}
+	p.saved[raddr] = ports[1:]
+	return ports[0]
+}
+
+// track records the local port of session to raddr until it is closed
+func (p *portPins) track(raddr string, laddr net.Addr, session *smux.Session) {
+	udpaddr, ok := laddr.(*net.UDPAddr)
+	if p == nil || !ok {
+		return
+	}
+
+	p.mu.Lock()
+	if p.live[raddr] == nil {
+		p.live[raddr] = make(map[int]bool)
+	}
+	p.live[raddr][udpaddr.Port] = true
+	p.save()
+	p.mu.Unlock()
+
+	go func() {
+		<-session.CloseChan()
+		p.mu.Lock()
+		delete(p.live[raddr], udpaddr.Port)
+		p.save()
+		p.mu.Unlock()
+	}()
+}
+
+// save writes the ports in use to the state file
+func (p *portPins) save() {
+	state := make(map[string][]int)
+	for raddr, ports := range p.live {
+		for port := range ports {
+			state[raddr] = append(state[raddr], port)
+		}
+	}
+	data, _ := json.Marshal(state)
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("statefile:", err)
+		return
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		log.Println("statefile:", err)
+	}
+}
+
+// listenUDP listens on a port of the previous run for the sessions to
+// raddr if any, or on a random port
+func listenUDP(network, raddr string) (*net.UDPConn, error) {
+	if port := pins.take(raddr); port > 0 {
+		if conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port}); err == nil {
+			log.Println("statefile: resuming from local port:", port)
+			return conn, nil
+		}
+	}
+	return net.ListenUDP(network, nil)
+}
@@ -3,13 +3,16 @@ module github.com/xtaci/kcptun
 require (
 	github.com/fatih/color v1.18.0
 	github.com/golang/snappy v1.0.0
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/pkg/errors v0.9.1
+	github.com/tjfoc/gmsm v1.4.1
 	github.com/urfave/cli v1.22.17
 	github.com/xtaci/kcp-go/v5 v5.6.24
 	github.com/xtaci/qpp v1.1.18
 	github.com/xtaci/smux v1.5.34
 	github.com/xtaci/tcpraw v1.2.31
 	golang.org/x/crypto v0.40.0
+	golang.org/x/net v0.42.0
 )
 
 require (
@@ -21,8 +24,6 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	github.com/tjfoc/gmsm v1.4.1 // indirect
-	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 )
 
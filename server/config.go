@@ -25,18 +25,46 @@ package main
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/std"
 )
 
 // Config for server
 type Config struct {
 	Listen       string `json:"listen"`
 	Target       string `json:"target"`
+	IPFamily     string `json:"ipfamily"`
+	MergePorts   bool   `json:"mergeports"`
+	Relay        string `json:"relay"`
+	Control      bool   `json:"control"`
+	Proxy        string `json:"proxy"`
+	PreDial      int    `json:"predial"`
+	PreDialIdle  int    `json:"predialidle"`
 	Key          string `json:"key"`
+	KeySource    string `json:"keysource"`
 	Crypt        string `json:"crypt"`
+	KDF          string `json:"kdf"`
+	KDFSalt      string `json:"kdfsalt"`
+	DirKeys      bool   `json:"dirkeys"`
+	HeaderMAC    bool   `json:"headermac"`
+	Obfs         string `json:"obfs"`
+	KeyRotate    int    `json:"keyrotate"`
+	BanLimit     int    `json:"banlimit"`
+	BanChurn     int    `json:"banchurn"`
+	BanWindow    int    `json:"banwindow"`
+	BanTime      int    `json:"bantime"`
+	GeoIP        string `json:"geoip"`
+	GeoIPAllow   string `json:"geoipallow"`
+	GeoIPDeny    string `json:"geoipdeny"`
+	Hook         string `json:"hook"`
+	KDFLegacy    bool   `json:"kdflegacy"`
 	Mode         string `json:"mode"`
 	MTU          int    `json:"mtu"`
 	SndWnd       int    `json:"sndwnd"`
 	RcvWnd       int    `json:"rcvwnd"`
+	AutoTune     bool   `json:"autotune"`
+	AutoTuneMin  int    `json:"autotunemin"`
 	DataShard    int    `json:"datashard"`
 	ParityShard  int    `json:"parityshard"`
 	DSCP         int    `json:"dscp"`
@@ -54,12 +82,51 @@ type Config struct {
 	Log          string `json:"log"`
 	SnmpLog      string `json:"snmplog"`
 	SnmpPeriod   int    `json:"snmpperiod"`
+	StatsPeriod  int    `json:"statsperiod"`
+	MetricsPush  string `json:"metricspush"`
+	OTLP         string `json:"otlp"`
+	DiagFile     string `json:"diagfile"`
+	Sample       int    `json:"sample"`
+	Health       string `json:"health"`
 	Pprof        bool   `json:"pprof"`
 	Quiet        bool   `json:"quiet"`
 	TCP          bool   `json:"tcp"`
 	QPP          bool   `json:"qpp"`
 	QPPCount     int    `json:"qpp-count"`
 	CloseWait    int    `json:"closewait"`
+	AuthKey      string `json:"authkey"`
+	AuthCert     string `json:"authcert"`
+	AuthPeers    string `json:"authpeers"`
+
+	// socket options of the local TCP connections
+	TCPNoDelay   bool `json:"tcpnodelay"`
+	TCPKeepAlive int  `json:"tcpkeepalive"`
+	TCPRcvBuf    int  `json:"tcprcvbuf"`
+	TCPSndBuf    int  `json:"tcpsndbuf"`
+	TCPDSCP      int  `json:"tcpdscp"`
+
+	// stream timeouts in seconds, 0 to disable
+	StreamIdle     int `json:"streamidle"`
+	StreamLifetime int `json:"streamlifetime"`
+
+	// admission of the streams of each session, 0 for no limit, streams
+	// over the limits wait for up to AdmitWait milliseconds
+	MaxStreams int `json:"maxstreams"`
+	StreamRate int `json:"streamrate"`
+	AdmitWait  int `json:"admitwait"`
+
+	// access log of the completed streams, rotated at AccessLogSize MB
+	AccessLog     string `json:"accesslog"`
+	AccessLogSize int    `json:"accesslogsize"`
+
+	// Forwards overrides the fields above per forwarding rule, eg:
+	// [{"listen":":4000","target":"127.0.0.1:22","crypt":"salsa20"}]
+	Forwards []json.RawMessage `json:"forwards"`
+
+	// the upstream proxy parsed from Proxy, and the connections to
+	// target dialed ahead, set by runServer
+	proxy   *std.ProxyDialer
+	predial *std.PreDialer
 }
 
 func parseJSONConfig(config *Config, path string) error {
@@ -71,3 +138,30 @@ func parseJSONConfig(config *Config, path string) error {
 
 	return json.NewDecoder(file).Decode(config)
 }
+
+// forwardConfigs expands the forwarding rules of config, every rule inherits
+// all the settings of config and overrides the fields it specifies.
+// config itself is the only rule if no forwards are given.
+func forwardConfigs(config *Config) ([]Config, error) {
+	if len(config.Forwards) == 0 {
+		return []Config{*config}, nil
+	}
+
+	rules := make([]Config, 0, len(config.Forwards))
+	for k := range config.Forwards {
+		rule := *config
+		rule.Forwards = nil
+		if err := json.Unmarshal(config.Forwards[k], &rule); err != nil {
+			return nil, errors.Wrapf(err, "forwards[%v]", k)
+		}
+		if rule.Key != config.Key { // overridden by the rule
+			key, err := std.ResolveSecret(rule.KeySource, rule.Key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "forwards[%v]", k)
+			}
+			rule.Key = key
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
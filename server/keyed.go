@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/kcptun/std"
+)
+
+// keyedServer serves kcp with multiple keys on one packet connection,
+// each key has its own listener and packets are dispatched to the
+// listener of the key they're encrypted with.
+type keyedServer struct {
+	config     *Config
+	demux      *std.PacketDemux
+	classifier *std.CryptClassifier
+	bans       *std.BanList
+	geo        *std.GeoFilter
+	serve      func(lis *kcp.Listener)
+
+	listeners map[int]*kcp.Listener
+	mu        sync.Mutex
+}
+
+func newKeyedServer(conn net.PacketConn, config *Config, bans *std.BanList, geo *std.GeoFilter, serve func(lis *kcp.Listener)) *keyedServer {
+	s := new(keyedServer)
+	s.config = config
+	s.classifier = std.NewCryptClassifier()
+	s.bans = bans
+	s.geo = geo
+	s.demux = std.NewPacketDemux(conn, s.classify)
+	s.serve = serve
+	s.listeners = make(map[int]*kcp.Listener)
+	return s
+}
+
+// classify drops the packets from banned or filtered sources before
+// decryption, and records the checksum failures of the others
+func (s *keyedServer) classify(p []byte, addr net.Addr) int {
+	if s.geo != nil && !s.geo.Allowed(addr) {
+		return -1
+	}
+	if s.bans == nil {
+		return s.classifier.Classify(p, addr)
+	}
+
+	if s.bans.Banned(addr) {
+		return -1
+	}
+	idx := s.classifier.Classify(p, addr)
+	if idx < 0 {
+		s.bans.Fail(addr, "checksum")
+	}
+	return idx
+}
+
+// add starts serving the clients with key idx
+func (s *keyedServer) add(idx int, block kcp.BlockCrypt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.listeners[idx]; ok {
+		return nil
+	}
+
+	lis, err := kcp.ServeConn(block, s.config.DataShard, s.config.ParityShard, s.demux.Conn(idx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.classifier.Add(idx, block)
+	s.listeners[idx] = lis
+	s.serve(lis)
+	return nil
+}
+
+// remove stops serving the clients with key idx, the sessions on it
+// will be timed out by their peers.
+func (s *keyedServer) remove(idx int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lis, ok := s.listeners[idx]
+	if !ok {
+		return
+	}
+
+	s.classifier.Remove(idx)
+	lis.Close()
+	s.demux.Conn(idx).Close()
+	delete(s.listeners, idx)
+}
@@ -23,7 +23,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"log"
@@ -32,12 +31,12 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
 	"github.com/fatih/color"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/kcptun/std"
@@ -47,8 +46,6 @@ import (
 )
 
 const (
-	// SALT is use for pbkdf2 key expansion
-	SALT = "kcp-go"
 	// maximum supported smux version
 	maxSmuxVer = 2
 )
@@ -82,16 +79,54 @@ func main() {
 			Value: "127.0.0.1:12948",
 			Usage: "target server address, or path/to/unix_socket",
 		},
+		cli.BoolFlag{
+			Name:  "mergeports",
+			Usage: "serve all the udp ports of a multiport listen address with one session table, so clients can hop between them",
+		},
+		cli.StringFlag{
+			Name:  "relay",
+			Value: "",
+			Usage: "comma separated udp addresses of the next kcptun servers that clients may chain to through this server, requires -control",
+		},
+		cli.BoolFlag{
+			Name:  "control",
+			Usage: "read the first stream of every connection as a control stream, for the -ping and chain of clients, must be the same on both sides",
+		},
+		cli.StringFlag{
+			Name:  "proxy",
+			Value: "",
+			Usage: "dial the target through an upstream proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port",
+		},
+		cli.IntFlag{
+			Name:  "predial",
+			Value: 0,
+			Usage: "keep N connections to the tcp target dialed ahead of the streams, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "predialidle",
+			Value: 10,
+			Usage: "redial the connections dialed ahead after N seconds idle, shorter than the idle timeout of target",
+		},
+		cli.StringFlag{
+			Name:  "ipfamily",
+			Value: "",
+			Usage: "ip family: dual, prefer-ipv4, prefer-ipv6, ipv4, ipv6, empty for the system default",
+		},
 		cli.StringFlag{
 			Name:   "key",
 			Value:  "it's a secrect",
-			Usage:  "pre-shared secret between client and server",
+			Usage:  "pre-shared secret between client and server, or a reference to it in -keysource",
 			EnvVar: "KCPTUN_KEY",
 		},
+		cli.StringFlag{
+			Name:  "keysource",
+			Value: "", // the key itself
+			Usage: "where the key is read from, with -key as the reference: env for an environment variable, file, fd for a file descriptor, or exec for the output of a command",
+		},
 		cli.StringFlag{
 			Name:  "crypt",
 			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
+			Usage: "aes, aes-128, aes-192, salsa20, xchacha20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null",
 		},
 		cli.BoolFlag{
 			Name:  "QPP",
@@ -103,6 +138,79 @@ func main() {
 			Usage: "the prime number of pads to use for QPP: The more pads you use, the more secure the encryption. Each pad requires 256 bytes.",
 		},
 
+		cli.StringFlag{
+			Name:  "kdf",
+			Value: "pbkdf2",
+			Usage: "key derivation function: pbkdf2, argon2id, pbkdf2-sm3",
+		},
+		cli.StringFlag{
+			Name:   "kdfsalt",
+			Value:  "",
+			Usage:  "per-deployment salt for key derivation, must be identical on both sides",
+			EnvVar: "KCPTUN_KDFSALT",
+		},
+		cli.BoolFlag{
+			Name:  "headermac",
+			Usage: "tag the packets to drop forged ones before decryption, must be identical on both sides",
+		},
+		cli.StringFlag{
+			Name:  "obfs",
+			Value: "",
+			Usage: "pipe the packets through an external obfuscation plugin, the command to run with its arguments",
+		},
+		cli.BoolFlag{
+			Name:  "dirkeys",
+			Usage: "encrypt the packets of each direction with an independent key, must be identical on both sides",
+		},
+		cli.IntFlag{
+			Name:  "keyrotate",
+			Value: 0, // disabled
+			Usage: "switch to a key derived from 'key' every N seconds, 0 to disable, clocks must be synchronized, this separates the keys of the epochs but gives no forward secrecy",
+		},
+		cli.BoolFlag{
+			Name:  "kdflegacy",
+			Usage: "also accept clients with keys derived by pbkdf2 while migrating to a new kdf",
+		},
+		cli.IntFlag{
+			Name:  "banlimit",
+			Value: 0, // disabled
+			Usage: "ban a source IP after N checksum or handshake failures within banwindow, 0 to disable, checksum failures are only counted with several keys",
+		},
+		cli.IntFlag{
+			Name:  "banchurn",
+			Value: 0, // disabled
+			Usage: "ban a source IP creating more than N sessions within banwindow, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "banwindow",
+			Value: 60,
+			Usage: "the window to count failures and sessions for banning, in seconds",
+		},
+		cli.IntFlag{
+			Name:  "bantime",
+			Value: 600,
+			Usage: "how long a source IP is banned, in seconds",
+		},
+		cli.StringFlag{
+			Name:  "geoip",
+			Value: "",
+			Usage: "MaxMind format GeoIP country database for access control, e.g. GeoLite2-Country.mmdb",
+		},
+		cli.StringFlag{
+			Name:  "geoipallow",
+			Value: "",
+			Usage: "comma separated country codes allowed, empty to allow all countries not denied",
+		},
+		cli.StringFlag{
+			Name:  "geoipdeny",
+			Value: "",
+			Usage: "comma separated country codes denied",
+		},
+		cli.StringFlag{
+			Name:  "hook",
+			Value: "",
+			Usage: "deliver session and stream events as json to a http(s) URL, or to a command via stdin",
+		},
 		cli.StringFlag{
 			Name:  "mode",
 			Value: "fast",
@@ -123,6 +231,15 @@ func main() {
 			Value: 1024,
 			Usage: "set receive window size(num of packets)",
 		},
+		cli.BoolFlag{
+			Name:  "autotune",
+			Usage: "adjust the windows of every connection to the measured loss, rtt and throughput, up to sndwnd and rcvwnd",
+		},
+		cli.IntFlag{
+			Name:  "autotunemin",
+			Value: 32,
+			Usage: "the smallest window autotune may set",
+		},
 		cli.IntFlag{
 			Name:  "datashard,ds",
 			Value: 10,
@@ -170,7 +287,7 @@ func main() {
 		cli.IntFlag{
 			Name:  "sockbuf",
 			Value: 4194304, // socket buffer size in bytes
-			Usage: "per-socket buffer in bytes",
+			Usage: "per-socket buffer in bytes, 0 to size it from the windows",
 		},
 		cli.IntFlag{
 			Name:  "smuxver",
@@ -197,6 +314,55 @@ func main() {
 			Value: 30,
 			Usage: "the seconds to wait before tearing down a connection",
 		},
+		cli.BoolTFlag{
+			Name:  "tcpnodelay",
+			Usage: "set TCP_NODELAY on the local TCP connections, true by default",
+		},
+		cli.IntFlag{
+			Name:  "tcpkeepalive",
+			Value: 0, // system default
+			Usage: "keepalive interval of the local TCP connections in seconds, 0 for the system default, -1 to disable",
+		},
+		cli.IntFlag{
+			Name:  "tcprcvbuf",
+			Value: 0, // system default
+			Usage: "SO_RCVBUF of the local TCP connections in bytes, 0 for the system default",
+		},
+		cli.IntFlag{
+			Name:  "tcpsndbuf",
+			Value: 0, // system default
+			Usage: "SO_SNDBUF of the local TCP connections in bytes, 0 for the system default",
+		},
+		cli.IntFlag{
+			Name:  "tcpdscp",
+			Value: 0, // system default
+			Usage: "DSCP(6bit) of the local TCP connections, 0 for the system default",
+		},
+		cli.IntFlag{
+			Name:  "streamidle",
+			Value: 0, // disabled
+			Usage: "close a stream without data in either direction for N seconds, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "streamlifetime",
+			Value: 0, // disabled
+			Usage: "close a stream N seconds after opened, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "maxstreams",
+			Value: 0,
+			Usage: "admit at most N concurrent streams per session, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "streamrate",
+			Value: 0,
+			Usage: "admit at most N new streams per second per session, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "admitwait",
+			Value: 0,
+			Usage: "wait for up to N milliseconds for the limits of admission before rejecting, 0 to reject immediately",
+		},
 		cli.StringFlag{
 			Name:  "snmplog",
 			Value: "",
@@ -207,6 +373,46 @@ func main() {
 			Value: 60,
 			Usage: "snmp collect period, in seconds",
 		},
+		cli.IntFlag{
+			Name:  "statsperiod",
+			Value: 0,
+			Usage: "log a summary of the throughput, streams, retransmissions and FEC recoveries every N seconds, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "accesslog",
+			Value: "",
+			Usage: "append a json line for every completed stream to this file",
+		},
+		cli.IntFlag{
+			Name:  "accesslogsize",
+			Value: 100,
+			Usage: "rotate the access log once it exceeds N megabytes, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "otlp",
+			Value: "",
+			Usage: "trace the stream lifecycles to an OpenTelemetry collector at the OTLP/HTTP endpoint, eg: http://localhost:4318",
+		},
+		cli.StringFlag{
+			Name:  "metricspush",
+			Value: "",
+			Usage: "push the snmp metrics every snmpperiod to statsd://host:port, influx://host:port or an InfluxDB http(s) write url",
+		},
+		cli.StringFlag{
+			Name:  "diagfile",
+			Value: "",
+			Usage: "append the diagnostic snapshots on SIGUSR1 to this file instead of the log",
+		},
+		cli.IntFlag{
+			Name:  "sample",
+			Value: 0,
+			Usage: "log the source, size and kcp header of 1 of every N packets received, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "health",
+			Value: "",
+			Usage: "serve the tunnel health as json and the /healthz and /readyz probes on this tcp address or unix socket path, eg: 127.0.0.1:12949",
+		},
 		cli.BoolFlag{
 			Name:  "pprof",
 			Usage: "start profiling server on :6060",
@@ -224,6 +430,21 @@ func main() {
 			Name:  "tcp",
 			Usage: "to emulate a TCP connection(linux)",
 		},
+		cli.StringFlag{
+			Name:  "authkey",
+			Value: "",
+			Usage: "ed25519 private key(PEM) to enable mutual authentication",
+		},
+		cli.StringFlag{
+			Name:  "authcert",
+			Value: "",
+			Usage: "certificate(PEM) of the authkey issued by a CA, optional",
+		},
+		cli.StringFlag{
+			Name:  "authpeers",
+			Value: "",
+			Usage: "trusted public keys and CA certificates(PEM) of the peers",
+		},
 		cli.StringFlag{
 			Name:  "c",
 			Value: "", // when the value is not empty, the config path must exists
@@ -234,12 +455,37 @@ func main() {
 		config := Config{}
 		config.Listen = c.String("listen")
 		config.Target = c.String("target")
+		config.IPFamily = c.String("ipfamily")
+		config.MergePorts = c.Bool("mergeports")
+		config.Relay = c.String("relay")
+		config.Control = c.Bool("control")
+		config.Proxy = c.String("proxy")
+		config.PreDial = c.Int("predial")
+		config.PreDialIdle = c.Int("predialidle")
 		config.Key = c.String("key")
+		config.KeySource = c.String("keysource")
 		config.Crypt = c.String("crypt")
+		config.KDF = c.String("kdf")
+		config.KDFSalt = c.String("kdfsalt")
+		config.DirKeys = c.Bool("dirkeys")
+		config.HeaderMAC = c.Bool("headermac")
+		config.Obfs = c.String("obfs")
+		config.KeyRotate = c.Int("keyrotate")
+		config.BanLimit = c.Int("banlimit")
+		config.BanChurn = c.Int("banchurn")
+		config.BanWindow = c.Int("banwindow")
+		config.BanTime = c.Int("bantime")
+		config.GeoIP = c.String("geoip")
+		config.GeoIPAllow = c.String("geoipallow")
+		config.GeoIPDeny = c.String("geoipdeny")
+		config.Hook = c.String("hook")
+		config.KDFLegacy = c.Bool("kdflegacy")
 		config.Mode = c.String("mode")
 		config.MTU = c.Int("mtu")
 		config.SndWnd = c.Int("sndwnd")
 		config.RcvWnd = c.Int("rcvwnd")
+		config.AutoTune = c.Bool("autotune")
+		config.AutoTuneMin = c.Int("autotunemin")
 		config.DataShard = c.Int("datashard")
 		config.ParityShard = c.Int("parityshard")
 		config.DSCP = c.Int("dscp")
@@ -257,12 +503,33 @@ func main() {
 		config.Log = c.String("log")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
+		config.StatsPeriod = c.Int("statsperiod")
+		config.MetricsPush = c.String("metricspush")
+		config.OTLP = c.String("otlp")
+		config.AccessLog = c.String("accesslog")
+		config.AccessLogSize = c.Int("accesslogsize")
+		config.DiagFile = c.String("diagfile")
+		config.Sample = c.Int("sample")
+		config.Health = c.String("health")
 		config.Pprof = c.Bool("pprof")
 		config.Quiet = c.Bool("quiet")
 		config.TCP = c.Bool("tcp")
 		config.QPP = c.Bool("QPP")
 		config.QPPCount = c.Int("QPPCount")
 		config.CloseWait = c.Int("closewait")
+		config.TCPNoDelay = c.BoolT("tcpnodelay")
+		config.TCPKeepAlive = c.Int("tcpkeepalive")
+		config.TCPRcvBuf = c.Int("tcprcvbuf")
+		config.TCPSndBuf = c.Int("tcpsndbuf")
+		config.TCPDSCP = c.Int("tcpdscp")
+		config.StreamIdle = c.Int("streamidle")
+		config.StreamLifetime = c.Int("streamlifetime")
+		config.MaxStreams = c.Int("maxstreams")
+		config.StreamRate = c.Int("streamrate")
+		config.AdmitWait = c.Int("admitwait")
+		config.AuthKey = c.String("authkey")
+		config.AuthCert = c.String("authcert")
+		config.AuthPeers = c.String("authpeers")
 
 		if c.String("c") != "" {
 			//Now only support json config file
@@ -270,6 +537,11 @@ func main() {
 			checkError(err)
 		}
 
+		// secrets from external sources
+		key, err := std.ResolveSecret(config.KeySource, config.Key)
+		checkError(err)
+		config.Key = key
+
 		// log redirect
 		if config.Log != "" {
 			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -278,178 +550,466 @@ func main() {
 			log.SetOutput(f)
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
-		}
-
 		log.Println("version:", VERSION)
-		log.Println("smux version:", config.SmuxVer)
-		log.Println("listening on:", config.Listen)
-		log.Println("target:", config.Target)
-		log.Println("encryption:", config.Crypt)
-		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("compression:", !config.NoComp)
-		log.Println("mtu:", config.MTU)
-		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
-		log.Println("acknodelay:", config.AckNodelay)
-		log.Println("dscp:", config.DSCP)
-		log.Println("sockbuf:", config.SockBuf)
-		log.Println("smuxbuf:", config.SmuxBuf)
-		log.Println("streambuf:", config.StreamBuf)
-		log.Println("keepalive:", config.KeepAlive)
-		log.Println("snmplog:", config.SnmpLog)
-		log.Println("snmpperiod:", config.SnmpPeriod)
-		log.Println("pprof:", config.Pprof)
-		log.Println("quiet:", config.Quiet)
-		log.Println("tcp:", config.TCP)
-
-		if config.QPP {
-			minSeedLength := qpp.QPPMinimumSeedLength(8)
-			if len(config.Key) < minSeedLength {
-				color.Red("QPP Warning: 'key' has size of %d bytes, required %d bytes at least", len(config.Key), minSeedLength)
-			}
 
-			minPads := qpp.QPPMinimumPads(8)
-			if config.QPPCount < minPads {
-				color.Red("QPP Warning: QPPCount %d, required %d at least", config.QPPCount, minPads)
-			}
+		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+		go std.StatsLogger(config.StatsPeriod)
+		go std.MetricsPusher(config.MetricsPush, "server", config.SnmpPeriod)
 
-			if new(big.Int).GCD(nil, nil, big.NewInt(int64(config.QPPCount)), big.NewInt(8)).Int64() != 1 {
-				color.Red("QPP Warning: QPPCount %d, choose a prime number for security", config.QPPCount)
-			}
-		}
-		// parameters check
-		if config.SmuxVer > maxSmuxVer {
-			log.Fatal("unsupported smux version:", config.SmuxVer)
-		}
-
-		log.Println("initiating key derivation")
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
-		log.Println("key derivation done")
-		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "null":
-			block = nil
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
+		// diagnostic snapshots on SIGUSR1
+		std.SetDiagFile(config.DiagFile)
+		if config.Sample > 0 {
+			std.SetSampleRate(uint64(config.Sample))
 		}
 
-		go std.SnmpLogger(config.SnmpLog, config.SnmpPeriod)
+		// tunnel health and the probes of orchestrators
+		if config.Health != "" {
+			checkError(std.ServeHealth(config.Health))
+		}
 		if config.Pprof {
 			go http.ListenAndServe(":6060", nil)
 		}
 
-		// create shared QPP
-		var _Q_ *qpp.QuantumPermutationPad
-		if config.QPP {
-			_Q_ = qpp.NewQPP([]byte(config.Key), uint16(config.QPPCount))
-		}
+		// expand forwarding rules
+		rules, err := forwardConfigs(&config)
+		checkError(err)
 
-		// main loop
 		var wg sync.WaitGroup
-		loop := func(lis *kcp.Listener) {
-			defer wg.Done()
-			if err := lis.SetDSCP(config.DSCP); err != nil {
-				log.Println("SetDSCP:", err)
-			}
-			if err := lis.SetReadBuffer(config.SockBuf); err != nil {
-				log.Println("SetReadBuffer:", err)
-			}
-			if err := lis.SetWriteBuffer(config.SockBuf); err != nil {
-				log.Println("SetWriteBuffer:", err)
-			}
+		for k := range rules {
+			wg.Add(1)
+			go func(config *Config) {
+				defer wg.Done()
+				checkError(runServer(config))
+			}(&rules[k])
+		}
+		wg.Wait()
+		return nil
+	}
+	myApp.Run(os.Args)
+}
 
-			for {
-				if conn, err := lis.AcceptKCP(); err == nil {
-					log.Println("remote address:", conn.RemoteAddr())
-					conn.SetStreamMode(true)
-					conn.SetWriteDelay(false)
-					conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-					conn.SetMtu(config.MTU)
-					conn.SetWindowSize(config.SndWnd, config.RcvWnd)
-					conn.SetACKNoDelay(config.AckNodelay)
+// runServer starts a server instance for a single forwarding rule
+func runServer(config *Config) error {
+	switch config.Mode {
+	case "normal":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
+	case "fast":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
+	case "fast2":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
+	case "fast3":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+	}
+
+	log.Println("smux version:", config.SmuxVer)
+	log.Println("listening on:", config.Listen)
+	log.Println("target:", config.Target)
+	log.Println("ipfamily:", config.IPFamily)
+	log.Println("mergeports:", config.MergePorts)
+	log.Println("relay:", config.Relay)
+	log.Println("control:", config.Control)
+	log.Println("proxy:", config.Proxy)
+	log.Println("predial:", config.PreDial, "predialidle:", config.PreDialIdle)
+	log.Println("encryption:", config.Crypt)
+	log.Println("kdf:", config.KDF)
+	log.Println("dirkeys:", config.DirKeys)
+	log.Println("headermac:", config.HeaderMAC)
+	log.Println("obfs:", config.Obfs)
+	log.Println("kdflegacy:", config.KDFLegacy)
+	log.Println("keyrotate:", config.KeyRotate)
+	log.Println("hook:", config.Hook)
+	log.Println("geoip:", config.GeoIP, "allow:", config.GeoIPAllow, "deny:", config.GeoIPDeny)
+	log.Println("banlimit:", config.BanLimit, "banchurn:", config.BanChurn, "banwindow:", config.BanWindow, "bantime:", config.BanTime)
+	log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+	log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
+	log.Println("autotune:", config.AutoTune, "autotunemin:", config.AutoTuneMin)
+	log.Println("compression:", !config.NoComp)
+	log.Println("mtu:", config.MTU)
+	log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+	log.Println("acknodelay:", config.AckNodelay)
+	log.Println("dscp:", config.DSCP)
+	if config.SockBuf == 0 { // sized from the windows
+		config.SockBuf = std.AutoSockBuf(config.SndWnd, config.RcvWnd, config.MTU)
+	}
+	log.Println("sockbuf:", config.SockBuf)
+	log.Println("smuxbuf:", config.SmuxBuf)
+	log.Println("streambuf:", config.StreamBuf)
+	log.Println("keepalive:", config.KeepAlive)
+	log.Println("tcpnodelay:", config.TCPNoDelay, "tcpkeepalive:", config.TCPKeepAlive, "tcprcvbuf:", config.TCPRcvBuf, "tcpsndbuf:", config.TCPSndBuf, "tcpdscp:", config.TCPDSCP)
+	log.Println("streamidle:", config.StreamIdle, "streamlifetime:", config.StreamLifetime)
+	log.Println("maxstreams:", config.MaxStreams, "streamrate:", config.StreamRate, "admitwait:", config.AdmitWait)
+	log.Println("snmplog:", config.SnmpLog)
+	log.Println("snmpperiod:", config.SnmpPeriod)
+	log.Println("statsperiod:", config.StatsPeriod)
+	log.Println("metricspush:", config.MetricsPush)
+	log.Println("otlp:", config.OTLP)
+	log.Println("accesslog:", config.AccessLog, "accesslogsize:", config.AccessLogSize)
+	log.Println("diagfile:", config.DiagFile)
+	log.Println("sample:", config.Sample)
+	log.Println("health:", config.Health)
+	log.Println("pprof:", config.Pprof)
+	log.Println("authkey:", config.AuthKey)
+	log.Println("quiet:", config.Quiet)
+	log.Println("tcp:", config.TCP)
+
+	if config.QPP {
+		minSeedLength := qpp.QPPMinimumSeedLength(8)
+		if len(config.Key) < minSeedLength {
+			color.Red("QPP Warning: 'key' has size of %d bytes, required %d bytes at least", len(config.Key), minSeedLength)
+		}
+
+		minPads := qpp.QPPMinimumPads(8)
+		if config.QPPCount < minPads {
+			color.Red("QPP Warning: QPPCount %d, required %d at least", config.QPPCount, minPads)
+		}
+
+		if new(big.Int).GCD(nil, nil, big.NewInt(int64(config.QPPCount)), big.NewInt(8)).Int64() != 1 {
+			color.Red("QPP Warning: QPPCount %d, choose a prime number for security", config.QPPCount)
+		}
+	}
+	// KDF parameters check
+	if config.KDF == std.KDFArgon2id && config.KDFSalt == "" {
+		color.Red("KDF Warning: 'kdfsalt' is not set, choose a per-deployment salt for argon2id")
+	}
+	if limit := std.SockBufMax(); limit > 0 && config.SockBuf > limit {
+		color.Red("WARNING: sockbuf %d is capped by the kernel to %d, raise net.core.rmem_max and net.core.wmem_max", config.SockBuf, limit)
+	}
+
+	// parameters check
+	if config.SmuxVer > maxSmuxVer {
+		log.Fatal("unsupported smux version:", config.SmuxVer)
+	}
+
+	log.Println("initiating key derivation")
+	pass, err := std.DeriveKey(config.KDF, config.Key, config.KDFSalt)
+	if err != nil {
+		return err
+	}
+	log.Println("key derivation done")
+	var block kcp.BlockCrypt
+	block, config.Crypt = std.NewBlockCrypt(config.Crypt, pass)
+	if config.DirKeys {
+		block = std.NewDirectionalBlockCrypt(config.Crypt, pass, true)
+	}
+
+	// relay streams are control streams
+	if config.Relay != "" && !config.Control {
+		return errors.New("relay requires control")
+	}
+
+	// the connections to target are dialed through the upstream proxy
+	if config.proxy, err = std.NewProxyDialer(config.Proxy); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(config.Target); err != nil && config.proxy != nil {
+		return errors.New("proxy requires a tcp target")
+	}
+
+	// connections to the tcp target are dialed ahead of the streams
+	if _, _, err := net.SplitHostPort(config.Target); err == nil && config.PreDial > 0 {
+		if config.PreDialIdle <= 0 {
+			return errors.New("predialidle must be positive")
+		}
+		config.predial = std.NewPreDialer(func() (net.Conn, error) { return dialTarget(config) }, config.PreDial, time.Duration(config.PreDialIdle)*time.Second)
+	}
+
+	// mutual authentication
+	var auth *std.Authenticator
+	if config.AuthKey != "" {
+		if auth, err = std.NewAuthenticator(config.AuthKey, config.AuthCert, config.AuthPeers); err != nil {
+			return err
+		}
+	}
+
+	// during kdf migration, clients with keys derived from the legacy
+	// pbkdf2 are served on the same ports by another set of listeners
+	var legacyBlock kcp.BlockCrypt
+	if config.KDFLegacy && block != nil && config.KDF != std.KDFPBKDF2 {
+		legacyPass, err := std.DeriveKey(std.KDFPBKDF2, config.Key, "")
+		if err != nil {
+			return err
+		}
+		legacyBlock, _ = std.NewBlockCrypt(config.Crypt, legacyPass)
+	}
+
+	// automatic banning of abusive sources
+	var bans *std.BanList
+	if config.BanLimit > 0 || config.BanChurn > 0 {
+		bans = std.NewBanList(config.BanLimit, config.BanChurn, config.BanWindow, config.BanTime)
+	}
+
+	// GeoIP access control
+	var geo *std.GeoFilter
+	if config.GeoIP != "" {
+		if geo, err = std.NewGeoFilter(config.GeoIP, config.GeoIPAllow, config.GeoIPDeny); err != nil {
+			return err
+		}
+	}
+
+	// connection event hooks
+	var hook *std.Hook
+	if config.Hook != "" {
+		hook = std.NewHook(config.Hook)
+	}
+
+	// stream lifecycles are traced if an OTLP endpoint is set
+	tracer := std.NewTracer(config.OTLP, "kcptun-server")
+
+	// completed streams are logged to the access log
+	access, err := std.NewAccessLog(config.AccessLog, config.AccessLogSize)
+	if err != nil {
+		return err
+	}
+
+	// create shared QPP
+	var _Q_ *qpp.QuantumPermutationPad
+	if config.QPP {
+		_Q_ = qpp.NewQPP([]byte(config.Key), uint16(config.QPPCount))
+	}
+
+	// main loop
+	var wg sync.WaitGroup
+	loop := func(lis *kcp.Listener) {
+		defer wg.Done()
+		if err := lis.SetDSCP(config.DSCP); err != nil {
+			log.Println("SetDSCP:", err)
+		}
+		if err := lis.SetReadBuffer(config.SockBuf); err != nil {
+			log.Println("SetReadBuffer:", err)
+		}
+		if err := lis.SetWriteBuffer(config.SockBuf); err != nil {
+			log.Println("SetWriteBuffer:", err)
+		}
+
+		for {
+			if conn, err := lis.AcceptKCP(); err == nil {
+				log.Println("remote address:", conn.RemoteAddr())
+				if bans != nil {
+					bans.Session(conn.RemoteAddr())
+				}
+				conn.SetStreamMode(true)
+				conn.SetWriteDelay(false)
+				conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+				mtu := config.MTU
+				if config.HeaderMAC { // room for the tag
+					mtu -= std.HeaderMACSize
+				}
+				conn.SetMtu(mtu)
+				conn.SetWindowSize(config.SndWnd, config.RcvWnd)
+				conn.SetACKNoDelay(config.AckNodelay)
+
+				go func(kcpconn *kcp.UDPSession) {
+					var conn net.Conn = kcpconn
+					var identity string
+					if auth != nil {
+						sconn, err := auth.Server(conn)
+						if err != nil {
+							log.Println("auth:", err, "remote address:", conn.RemoteAddr())
+							if bans != nil {
+								bans.Fail(conn.RemoteAddr(), "handshake")
+							}
+							conn.Close()
+							return
+						}
+						log.Println("authenticated client:", sconn.Identity(), "remote address:", conn.RemoteAddr())
+						identity = sconn.Identity()
+						conn = sconn
+					}
+
+					if hook != nil {
+						start := time.Now()
+						hook.Fire(std.HookEvent{Event: "session_open", Remote: conn.RemoteAddr().String(), Identity: identity})
+						defer func() {
+							hook.Fire(std.HookEvent{Event: "session_close", Remote: conn.RemoteAddr().String(), Identity: identity,
+								Duration: time.Since(start).Seconds()})
+						}()
+					}
 
 					if config.NoComp {
-						go handleMux(_Q_, conn, &config)
+						handleMux(_Q_, conn, kcpconn, config, hook, tracer, access, identity)
 					} else {
-						go handleMux(_Q_, std.NewCompStream(conn), &config)
+						handleMux(_Q_, std.NewCompStream(conn), kcpconn, config, hook, tracer, access, identity)
 					}
-				} else {
-					log.Printf("%+v", err)
-				}
+				}(conn)
+			} else {
+				log.Printf("%+v", err)
+				return
 			}
 		}
+	}
 
-		mp, err := std.ParseMultiPort(config.Listen)
-		if err != nil {
-			log.Println(err)
+	// a packet transport other than udp is served instead of the ports
+	mp := &std.MultiPort{}
+	transport, transportAddr, isTransport := std.LookupTransport(config.Listen)
+	if !isTransport {
+		if mp, err = std.ParseMultiPort(config.Listen); err != nil {
 			return err
 		}
+	}
 
-		// create multiple listener
-		for port := mp.MinPort; port <= mp.MaxPort; port++ {
-			listenAddr := fmt.Sprintf("%v:%v", mp.Host, port)
-			if config.TCP { // tcp dual stack
-				if conn, err := tcpraw.Listen("tcp", listenAddr); err == nil {
-					log.Printf("Listening on: %v/tcp", listenAddr)
-					lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
-					checkError(err)
-					wg.Add(1)
-					go loop(lis)
-				} else {
-					log.Println(err)
-				}
+	// keys are rotated by epochs, the listeners of the previous, the
+	// current and the next epoch are kept to tolerate clock skews
+	rotator := std.NewKeyRotator(pass, config.Crypt, config.KeyRotate)
+	if block == nil {
+		rotator = std.NewKeyRotator(pass, config.Crypt, 0)
+	}
+	if config.DirKeys {
+		rotator.SetDirectional(true)
+	}
+	epochIdx := func(epoch int64) int { return int(epoch) + 1 } // 0 for the legacy key
+	var servers []*keyedServer
+
+	// packets are served by kcp directly unless they have to be
+	// dispatched by key, with a single key the sources are filtered by
+	// address only, so the packets are decrypted once, by kcp
+	direct := legacyBlock == nil && !rotator.Enabled()
+	filtered := bans != nil || geo != nil
+	allow := func(addr net.Addr) bool {
+		if geo != nil && !geo.Allowed(addr) {
+			return false
+		}
+		return bans == nil || !bans.Banned(addr)
+	}
+
+	// serve kcp on a packet connection
+	serve := func(conn net.PacketConn) error {
+		if direct && filtered {
+			conn = std.NewFilterConn(conn, allow)
+		}
+		if config.Obfs != "" {
+			obfs, err := std.NewObfsConn(conn, config.Obfs)
+			if err != nil {
+				return err
+			}
+			conn = obfs
+		}
+		if config.HeaderMAC {
+			conn = std.NewHeaderMACConn(conn, pass)
+		}
+		if config.Sample > 0 {
+			conn = std.NewPacketSampler(conn, block)
+		}
+		if direct {
+			lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+			if err != nil {
+				return errors.WithStack(err)
 			}
+			wg.Add(1)
+			go loop(lis)
+			return nil
+		}
 
-			// udp stack
-			log.Printf("Listening on: %v/udp", listenAddr)
-			lis, err := kcp.ListenWithOptions(listenAddr, block, config.DataShard, config.ParityShard)
-			checkError(err)
+		// packets are dispatched by the key they're encrypted with
+		s := newKeyedServer(conn, config, bans, geo, func(lis *kcp.Listener) {
 			wg.Add(1)
 			go loop(lis)
+		})
+		if legacyBlock != nil {
+			if err := s.add(0, legacyBlock); err != nil {
+				return err
+			}
 		}
 
-		wg.Wait()
+		epoch := rotator.Epoch(time.Now())
+		for e := epoch - 1; e <= epoch+1; e++ {
+			if !rotator.Enabled() && e != epoch {
+				continue
+			}
+			if err := s.add(epochIdx(e), rotator.Block(e)); err != nil {
+				return err
+			}
+		}
+		servers = append(servers, s)
 		return nil
 	}
-	myApp.Run(os.Args)
+
+	// create multiple listener
+	var merged []net.PacketConn
+	for _, port := range mp.Ports {
+		listenAddr := fmt.Sprintf("%v:%v", mp.Host, port)
+		if config.TCP { // tcp dual stack
+			for _, network := range std.IPListenNetworks("tcp", config.IPFamily, mp.Host) {
+				if conn, err := tcpraw.Listen(network, listenAddr); err == nil {
+					log.Printf("Listening on: %v/%v", listenAddr, network)
+					if err := serve(conn); err != nil {
+						return err
+					}
+				} else {
+					log.Println(err)
+				}
+			}
+		}
+
+		// udp stack
+		for _, network := range std.IPListenNetworks("udp", config.IPFamily, mp.Host) {
+			log.Printf("Listening on: %v/%v", listenAddr, network)
+			if config.MergePorts && len(mp.Ports) > 1 {
+				conn, err := net.ListenPacket(network, listenAddr)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				merged = append(merged, conn)
+			} else if direct && !filtered && network == "udp" && !config.HeaderMAC && config.Obfs == "" && config.Sample <= 0 {
+				lis, err := kcp.ListenWithOptions(listenAddr, block, config.DataShard, config.ParityShard)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				wg.Add(1)
+				go loop(lis)
+			} else {
+				conn, err := net.ListenPacket(network, listenAddr)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if err := serve(conn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// the udp ports share one session table
+	if len(merged) > 0 {
+		if err := serve(std.NewMultiPacketConn(merged)); err != nil {
+			return err
+		}
+	}
+
+	if isTransport {
+		conn, err := transport.Listen(transportAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Listening on: %v", config.Listen)
+		if err := serve(conn); err != nil {
+			return err
+		}
+	}
+
+	// key rotation at epoch boundaries
+	if rotator.Enabled() {
+		go func() {
+			epoch := rotator.Epoch(time.Now())
+			for {
+				<-time.After(time.Until(rotator.Boundary(epoch + 1)))
+				epoch++
+				for _, s := range servers {
+					if err := s.add(epochIdx(epoch+1), rotator.Block(epoch+1)); err != nil {
+						log.Println("keyrotate:", err)
+					}
+					s.remove(epochIdx(epoch - 2))
+				}
+				log.Println("key epoch:", epoch)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
 }
 
 // handle multiplex-ed connection
-func handleMux(_Q_ *qpp.QuantumPermutationPad, conn net.Conn, config *Config) {
+func handleMux(_Q_ *qpp.QuantumPermutationPad, conn net.Conn, kcpconn *kcp.UDPSession, config *Config, hook *std.Hook, tracer *std.Tracer, access *std.AccessLog, identity string) {
 	// check target type
 	targetType := TGT_TCP
 	if _, _, err := net.SplitHostPort(config.Target); err != nil {
@@ -464,49 +1024,147 @@ func handleMux(_Q_ *qpp.QuantumPermutationPad, conn net.Conn, config *Config) {
 	smuxConfig.MaxStreamBuffer = config.StreamBuf
 	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
 
+	// the next hops clients may chain to
+	var relays []string
+	if config.Relay != "" {
+		relays = strings.Split(config.Relay, ",")
+	}
+
+	// admission of the streams of the session
+	admit := std.NewAdmission(config.MaxStreams, config.StreamRate, time.Duration(config.AdmitWait)*time.Millisecond)
+
+	// socket options of the connections to target
+	tcpOptions := std.TCPOptions{NoDelay: config.TCPNoDelay, KeepAlive: config.TCPKeepAlive, ReadBuf: config.TCPRcvBuf, WriteBuf: config.TCPSndBuf, DSCP: config.TCPDSCP}
+
 	mux, err := smux.Server(conn, smuxConfig)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer mux.Close()
+	std.TrackSession("server "+config.Listen+" -> "+config.Target, kcpconn, mux, config.SndWnd, config.RcvWnd)
+	if config.AutoTune {
+		go std.AutoTune(kcpconn, mux, config.MTU, config.AutoTuneMin, config.SndWnd, config.RcvWnd)
+	}
 
-	for {
+	for first := true; ; first = false {
 		stream, err := mux.AcceptStream()
 		if err != nil {
 			log.Println(err)
 			return
 		}
 
-		go func(p1 *smux.Stream) {
+		go func(p1 *smux.Stream, first bool) {
+			// the ping and relay streams of clients are handled here
+			var relay bool
+			if first && config.Control {
+				control, err := std.AcceptControl(p1)
+				if err != nil {
+					log.Println("control:", err, "in:", p1.RemoteAddr())
+					mux.Close()
+					return
+				}
+				switch control {
+				case std.ControlPing:
+					std.AnswerPing(p1)
+					return
+				case std.ControlRelay:
+					relay = true
+				default:
+					p1.Close()
+					return
+				}
+			}
+			if !admit.Acquire() {
+				if !config.Quiet {
+					log.Println("stream rejected", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"))
+				}
+				p1.Close()
+				return
+			}
+			defer admit.Release()
+			if relay {
+				log.Println("relay opened", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"))
+				if err := std.ServeRelay(p1, relays); err != nil {
+					log.Println("relay:", err)
+				}
+				log.Println("relay closed", "in:", fmt.Sprint(p1.RemoteAddr(), "(", p1.ID(), ")"))
+				return
+			}
+
+			// stream accept -> target dial -> close
+			span := tracer.Start("kcptun.stream", std.SpanServer, nil)
+			span.Set("net.peer.addr", conn.RemoteAddr())
+			span.Set("smux.stream", p1.ID())
+			defer span.End()
+
 			var p2 net.Conn
 			var err error
 
+			dial := tracer.Start("dial", std.SpanClient, span)
+			dial.Set("net.peer.name", config.Target)
 			switch targetType {
 			case TGT_TCP:
-				p2, err = net.Dial("tcp", config.Target)
-				if err != nil {
-					log.Println(err)
-					p1.Close()
-					return
+				if config.predial != nil {
+					p2, err = config.predial.Dial()
+				} else {
+					p2, err = dialTarget(config)
 				}
-				handleClient(_Q_, []byte(config.Key), p1, p2, config.Quiet, config.CloseWait)
 			case TGT_UNIX:
 				p2, err = net.Dial("unix", config.Target)
-				if err != nil {
-					log.Println(err)
-					p1.Close()
-					return
-				}
-				handleClient(_Q_, []byte(config.Key), p1, p2, config.Quiet, config.CloseWait)
 			}
+			dial.End()
+			if err != nil {
+				log.Println(err)
+				span.Set("kcptun.close_reason", err)
+				p1.Close()
+				return
+			}
+			if err := tcpOptions.Apply(p2); err != nil {
+				log.Println("tcp options:", err)
+			}
+
+			if hook == nil && tracer == nil && access == nil {
+				handleClient(_Q_, []byte(config.Key), p1, p2, config.Quiet, config.CloseWait, config.StreamIdle, config.StreamLifetime)
+				return
+			}
+
+			// bytes in are sent from the client to the target
+			counted := std.NewCountedConn(p2)
+			start := time.Now()
+			ev := std.HookEvent{Event: "stream_open", Remote: conn.RemoteAddr().String(), Identity: identity,
+				Stream: p1.ID(), Target: config.Target}
+			if hook != nil {
+				hook.Fire(ev)
+			}
+			err1, err2 := handleClient(_Q_, []byte(config.Key), p1, counted, config.Quiet, config.CloseWait, config.StreamIdle, config.StreamLifetime)
+			reason := std.CloseReason(err1, err2)
+			span.Set("kcptun.bytes_up", counted.BytesOut())
+			span.Set("kcptun.bytes_down", counted.BytesIn())
+			span.Set("kcptun.close_reason", reason)
+			span.SetSession(mux)
+			access.Log(std.AccessEntry{Client: conn.RemoteAddr().String(), Target: config.Target, Stream: p1.ID(),
+				Identity: identity, Duration: time.Since(start).Seconds(),
+				BytesUp: counted.BytesOut(), BytesDown: counted.BytesIn(), Reason: reason})
+			if hook != nil {
+				ev.Event, ev.Duration = "stream_close", time.Since(start).Seconds()
+				ev.BytesIn, ev.BytesOut = counted.BytesOut(), counted.BytesIn()
+				hook.Fire(ev)
+			}
+		}(stream, first)
+	}
+}
 
-		}(stream)
+// dialTarget dials the tcp target, through the upstream proxy if set
+func dialTarget(config *Config) (net.Conn, error) {
+	if config.proxy != nil {
+		return config.proxy.Dial(config.Target)
 	}
+	return net.Dial("tcp", config.Target)
 }
 
-// handleClient pipes two streams
-func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream, p2 net.Conn, quiet bool, closeWait int) {
+// handleClient pipes two streams, and returns the errors of the pipe
+func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream, p2 net.Conn, quiet bool, closeWait, idle, lifetime int) (err1, err2 error) {
 	logln := func(v ...interface{}) {
 		if !quiet {
 			log.Println(v...)
@@ -527,7 +1185,7 @@ func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream,
 	}
 
 	// stream layer
-	err1, err2 := std.Pipe(s1, s2, closeWait)
+	err1, err2 = std.PipeTimeout(s1, s2, closeWait, idle, lifetime)
 
 	// handles transport layer errors
 	if err1 != nil && err1 != io.EOF {
@@ -536,6 +1194,7 @@ func handleClient(_Q_ *qpp.QuantumPermutationPad, seed []byte, p1 *smux.Stream,
 	if err2 != nil && err2 != io.EOF {
 		logln("pipe:", err2, "in:", p1.RemoteAddr(), "out:", fmt.Sprint(p2.RemoteAddr(), "(", p2.RemoteAddr(), ")"))
 	}
+	return
 }
 
 func checkError(err error) {
@@ -0,0 +1,149 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// rotated access logs kept as path.1 ... path.N
+	accessLogKeep = 5
+)
+
+// AccessEntry is written to the access log as a json line for every
+// completed stream
+type AccessEntry struct {
+	Time      string  `json:"time"` // RFC3339, the stream was closed at
+	Client    string  `json:"client"`
+	Target    string  `json:"target"`
+	Stream    uint32  `json:"stream"`
+	Identity  string  `json:"identity,omitempty"`
+	Duration  float64 `json:"duration"`   // seconds
+	BytesUp   int64   `json:"bytes_up"`   // from the client to the target
+	BytesDown int64   `json:"bytes_down"` // from the target to the client
+	Reason    string  `json:"reason"`
+}
+
+// AccessLog appends AccessEntry to a file, which is rotated once it grows
+// beyond a size limit. A nil *AccessLog discards the entries.
+type AccessLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+var (
+	accessLogs   = make(map[string]*AccessLog)
+	accessLogsMu sync.Mutex
+)
+
+// NewAccessLog opens the access log at path, which is rotated at maxSize
+// megabytes, or never if maxSize is 0. It returns nil if path is empty,
+// the forwarding rules logging to the same path share the AccessLog.
+func NewAccessLog(path string, maxSize int) (*AccessLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	accessLogsMu.Lock()
+	defer accessLogsMu.Unlock()
+	if a, ok := accessLogs[path]; ok {
+		return a, nil
+	}
+	a := &AccessLog{path: path, maxSize: int64(maxSize) << 20}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	accessLogs[path] = a
+	return a, nil
+}
+
+func (a *AccessLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "os.OpenFile")
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "f.Stat")
+	}
+	a.f, a.size = f, stat.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, ..., path to path.1, and reopens path
+func (a *AccessLog) rotate() error {
+	a.f.Close()
+	for i := accessLogKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", a.path, i), fmt.Sprintf("%v.%v", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		log.Println("accesslog:", err)
+	}
+	return a.open()
+}
+
+// Log writes e to the access log, the time is set if empty
+func (a *AccessLog) Log(e AccessEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time == "" {
+		e.Time = time.Now().Format(time.RFC3339)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Println("accesslog:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Println("accesslog:", err)
+			a.f = nil
+			return
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Println("accesslog:", err)
+	}
+}
@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	a, err := NewAccessLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.maxSize = 512
+	for i := 0; i < 20; i++ {
+		a.Log(AccessEntry{Client: "127.0.0.1:1234", Target: "127.0.0.1:22", Stream: uint32(i), BytesUp: 1, BytesDown: 2, Reason: "eof"})
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatal("not rotated:", err)
+	}
+	for _, p := range []string{path, path + ".1"} {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, _ := f.Stat()
+		if stat.Size() > a.maxSize {
+			t.Fatal("size", stat.Size(), "exceeds", a.maxSize)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e AccessEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Time == "" || e.Reason != "eof" {
+				t.Fatal("unexpected entry:", scanner.Text())
+			}
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,121 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// admission metrics, exported at /debug/vars along with pprof
+var admitStats = expvar.NewMap("admission")
+
+// Admission limits the concurrent connections and the rate of new ones,
+// a connection exceeding the limits waits for up to a timeout and is
+// rejected after, so that a port scan through the tunnel can't wedge it.
+type Admission struct {
+	slots chan struct{} // nil for unlimited concurrency
+	rate  float64       // per second, 0 for unlimited
+	wait  time.Duration
+
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewAdmission admits max concurrent connections and rate new ones per
+// second, waiting for up to wait, it returns nil if there is no limit.
+func NewAdmission(max, rate int, wait time.Duration) *Admission {
+	if max <= 0 && rate <= 0 {
+		return nil
+	}
+	a := &Admission{rate: float64(rate), wait: wait, tokens: float64(rate), last: time.Now()}
+	if max > 0 {
+		a.slots = make(chan struct{}, max)
+	}
+	return a
+}
+
+// Acquire admits a connection, which must Release once done, it returns
+// false if the connection is rejected. A nil Admission admits all.
+func (a *Admission) Acquire() bool {
+	if a == nil {
+		return true
+	}
+	deadline := time.Now().Add(a.wait)
+	if !a.take(deadline) {
+		admitStats.Add("rejected", 1)
+		return false
+	}
+
+	if a.slots != nil {
+		select {
+		case a.slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			select {
+			case a.slots <- struct{}{}:
+			case <-timer.C:
+				admitStats.Add("rejected", 1)
+				return false
+			}
+		}
+	}
+	admitStats.Add("admitted", 1)
+	return true
+}
+
+// Release frees the slot of an admitted connection
+func (a *Admission) Release() {
+	if a != nil && a.slots != nil {
+		<-a.slots
+	}
+}
+
+// take takes a token of the rate limit, a bucket of one second of tokens,
+// waiting until deadline at most
+func (a *Admission) take(deadline time.Time) bool {
+	if a.rate <= 0 {
+		return true
+	}
+	for {
+		a.mu.Lock()
+		now := time.Now()
+		a.tokens = min(a.rate, a.tokens+now.Sub(a.last).Seconds()*a.rate)
+		a.last = now
+		if a.tokens >= 1 {
+			a.tokens--
+			a.mu.Unlock()
+			return true
+		}
+		next := time.Duration((1 - a.tokens) / a.rate * float64(time.Second))
+		a.mu.Unlock()
+
+		if now.Add(next).After(deadline) {
+			return false
+		}
+		<-time.After(next)
+	}
+}
@@ -0,0 +1,72 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmissionConcurrency(t *testing.T) {
+	a := NewAdmission(2, 0, 50*time.Millisecond)
+	if !a.Acquire() || !a.Acquire() {
+		t.Fatal("rejected within the limit")
+	}
+	if a.Acquire() {
+		t.Fatal("admitted over the limit")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Release()
+	}()
+	if !a.Acquire() {
+		t.Fatal("rejected after a release")
+	}
+}
+
+func TestAdmissionRate(t *testing.T) {
+	a := NewAdmission(0, 10, 0)
+	for i := 0; i < 10; i++ {
+		if !a.Acquire() {
+			t.Fatal("rejected within the burst:", i)
+		}
+	}
+	if a.Acquire() {
+		t.Fatal("admitted over the rate")
+	}
+
+	// a token every 100ms
+	a = NewAdmission(0, 10, 150*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		a.Acquire()
+	}
+	if !a.Acquire() {
+		t.Fatal("rejected while waiting for a token")
+	}
+
+	var nilAdmission *Admission
+	if NewAdmission(0, 0, time.Second) != nil || !nilAdmission.Acquire() {
+		t.Fatal("unlimited admission")
+	}
+	nilAdmission.Release()
+}
@@ -0,0 +1,543 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// authentication protocol version
+	authVersion = 1
+
+	// the maximum time allowed for a handshake
+	authTimeout = 10 * time.Second
+
+	// credential types
+	credKey  = 0 // raw ed25519 public key
+	credCert = 1 // x509 certificate of an ed25519 key
+
+	// handshake status, the reasons of the rejections
+	authOK           = 0
+	authRejected     = 1 // no reason, as sent by older servers
+	authUntrusted    = 2
+	authBadSignature = 3
+
+	// the size of the MAC following a rejection status
+	authStatusMACSize = 16
+
+	// maximum plaintext in a single record
+	maxRecordSize = 16384
+)
+
+var (
+	authMagic = []byte("KCPA")
+
+	errUntrusted    = errors.New("untrusted peer credential")
+	errBadSignature = errors.New("bad handshake signature")
+)
+
+// AuthRejectedError is returned to the client when the server rejects
+// its credential in the handshake. Verified is true if the status was
+// authenticated by the server, the reason may be forged by anyone on the
+// path otherwise, e.g. with an older server.
+type AuthRejectedError struct {
+	Status   byte
+	Verified bool
+}
+
+func (e *AuthRejectedError) Error() string {
+	if !e.Verified {
+		return "authentication rejected by peer, unverified"
+	}
+	switch e.Status {
+	case authUntrusted:
+		return "authentication rejected by peer: untrusted credential"
+	case authBadSignature:
+		return "authentication rejected by peer: bad signature"
+	}
+	return "authentication rejected by peer"
+}
+
+// Authenticator performs mutual authentication with Ed25519 static keys or
+// certificates issued by a small CA, and secures the connection afterwards
+// with keys agreed in the handshake, so knowing the pre-shared key is not
+// enough to impersonate either side.
+type Authenticator struct {
+	key    ed25519.PrivateKey
+	cred   []byte // credential presented to the peer
+	pinned map[string]bool
+	roots  *x509.CertPool
+}
+
+// NewAuthenticator loads the PEM encoded Ed25519 private key from keyFile,
+// the optional certificate of the key from certFile, and the trusted peers
+// from peersFile, which may contain 'PUBLIC KEY' blocks of pinned peers and
+// 'CERTIFICATE' blocks of trusted CAs.
+func NewAuthenticator(keyFile, certFile, peersFile string) (*Authenticator, error) {
+	a := new(Authenticator)
+	a.pinned = make(map[string]bool)
+	a.roots = x509.NewCertPool()
+
+	// private key
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data found in %v", keyFile)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	key, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("not an ed25519 private key: %v", keyFile)
+	}
+	a.key = key
+	a.cred = append([]byte{credKey}, key.Public().(ed25519.PublicKey)...)
+
+	// certificate of the private key
+	if certFile != "" {
+		data, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf("no certificate found in %v", certFile)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if pub, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !pub.Equal(key.Public()) {
+			return nil, errors.Errorf("certificate does not match the private key: %v", certFile)
+		}
+		a.cred = append([]byte{credCert}, block.Bytes...)
+	}
+
+	// trusted peers
+	data, err = os.ReadFile(peersFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			edpub, ok := pub.(ed25519.PublicKey)
+			if !ok {
+				return nil, errors.Errorf("not an ed25519 public key in %v", peersFile)
+			}
+			a.pinned[string(edpub)] = true
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			a.roots.AddCert(cert)
+		}
+	}
+	return a, nil
+}
+
+// Client authenticates conn as the dialing side
+func (a *Authenticator) Client(conn net.Conn) (*SecureConn, error) {
+	return a.handshake(conn, true)
+}
+
+// Server authenticates conn as the accepting side
+func (a *Authenticator) Server(conn net.Conn) (*SecureConn, error) {
+	return a.handshake(conn, false)
+}
+
+// handshake:
+//
+//	C -> S: "KCPA" | version | client ephemeral
+//	S -> C: server ephemeral | server credential | signature
+//	C -> S: client credential | signature
+//	S -> C: status [| MAC if rejected]
+//
+// signatures cover the transcript so far, keys are derived from the
+// ephemeral X25519 secret and the transcript. A rejection is followed by
+// a MAC of the status keyed by the same, so the reason can't be forged,
+// an accepted status is confirmed by the records that follow.
+func (a *Authenticator) handshake(conn net.Conn, client bool) (*SecureConn, error) {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	transcript := sha256.New()
+	var peerEph *ecdh.PublicKey
+	var secret []byte
+	var identity string
+
+	if client {
+		hello := append(append(append([]byte{}, authMagic...), authVersion), eph.PublicKey().Bytes()...)
+		if err := writeFrame(conn, hello); err != nil {
+			return nil, err
+		}
+		transcript.Write(hello)
+
+		// server ephemeral, credential and signature
+		msg, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg) < 32 {
+			return nil, errors.New("malformed server hello")
+		}
+		if peerEph, err = ecdh.X25519().NewPublicKey(msg[:32]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if secret, err = eph.ECDH(peerEph); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cred, sig, err := splitCredential(msg[32:])
+		if err != nil {
+			return nil, err
+		}
+		transcript.Write(msg[:len(msg)-ed25519.SignatureSize])
+		if identity, err = a.verify(cred, transcript.Sum(nil), sig, x509.ExtKeyUsageServerAuth); err != nil {
+			return nil, err
+		}
+		transcript.Write(sig)
+
+		// client credential and signature
+		if err := writeFrame(conn, a.sign(nil, transcript)); err != nil {
+			return nil, err
+		}
+
+		status := make([]byte, 1)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if status[0] != authOK {
+			rejected := &AuthRejectedError{Status: status[0]}
+			mac := make([]byte, authStatusMACSize)
+			if _, err := io.ReadFull(conn, mac); err == nil {
+				rejected.Verified = hmac.Equal(mac, statusMAC(secret, transcript.Sum(nil), status[0]))
+			}
+			return nil, errors.WithStack(rejected)
+		}
+	} else {
+		hello, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(hello) != len(authMagic)+1+32 || !bytes.Equal(hello[:len(authMagic)], authMagic) {
+			return nil, errors.New("malformed client hello")
+		}
+		if hello[len(authMagic)] != authVersion {
+			return nil, errors.Errorf("unsupported auth version: %v", hello[len(authMagic)])
+		}
+		if peerEph, err = ecdh.X25519().NewPublicKey(hello[len(authMagic)+1:]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if secret, err = eph.ECDH(peerEph); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		transcript.Write(hello)
+
+		// server ephemeral, credential and signature
+		if err := writeFrame(conn, a.sign(eph.PublicKey().Bytes(), transcript)); err != nil {
+			return nil, err
+		}
+
+		// client credential and signature
+		msg, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		cred, sig, err := splitCredential(msg)
+		if err != nil {
+			return nil, err
+		}
+		transcript.Write(msg[:len(msg)-ed25519.SignatureSize])
+		digest := transcript.Sum(nil)
+		transcript.Write(sig)
+		if identity, err = a.verify(cred, digest, sig, x509.ExtKeyUsageClientAuth); err != nil {
+			status := byte(authUntrusted)
+			if errors.Cause(err) == errBadSignature {
+				status = authBadSignature
+			}
+			conn.Write(append([]byte{status}, statusMAC(secret, transcript.Sum(nil), status)...))
+			return nil, err
+		}
+
+		if _, err := conn.Write([]byte{authOK}); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return newSecureConn(conn, secret, transcript.Sum(nil), client, identity)
+}
+
+// statusMAC authenticates the rejection status of a handshake
+func statusMAC(secret []byte, transcript []byte, status byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("kcptun auth status"))
+	mac.Write(transcript)
+	mac.Write([]byte{status})
+	return mac.Sum(nil)[:authStatusMACSize]
+}
+
+// sign appends the credential and the signature over the transcript to prefix
+func (a *Authenticator) sign(prefix []byte, transcript hash.Hash) []byte {
+	msg := append(append([]byte{}, prefix...), byte(len(a.cred)>>8), byte(len(a.cred)))
+	msg = append(msg, a.cred...)
+	transcript.Write(msg)
+	sig := ed25519.Sign(a.key, transcript.Sum(nil))
+	transcript.Write(sig)
+	return append(msg, sig...)
+}
+
+// verify checks the peer credential and its signature, returns the identity of the peer,
+// a certificate must be issued for the role of the peer, usage
+func (a *Authenticator) verify(cred []byte, digest []byte, sig []byte, usage x509.ExtKeyUsage) (string, error) {
+	if len(cred) < 1 {
+		return "", errors.WithStack(errUntrusted)
+	}
+
+	var pub ed25519.PublicKey
+	var identity string
+	switch cred[0] {
+	case credKey:
+		if len(cred) != 1+ed25519.PublicKeySize || !a.pinned[string(cred[1:])] {
+			return "", errors.WithStack(errUntrusted)
+		}
+		pub = ed25519.PublicKey(cred[1:])
+	case credCert:
+		cert, err := x509.ParseCertificate(cred[1:])
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		var ok bool
+		if pub, ok = cert.PublicKey.(ed25519.PublicKey); !ok {
+			return "", errors.WithStack(errUntrusted)
+		}
+		if !a.pinned[string(pub)] {
+			// a certificate without extended key usages is valid for
+			// any role to x509, so the role is required explicitly
+			if !slices.Contains(cert.ExtKeyUsage, usage) {
+				return "", errors.Wrap(errUntrusted, "certificate not issued for the role of the peer")
+			}
+			opts := x509.VerifyOptions{Roots: a.roots, KeyUsages: []x509.ExtKeyUsage{usage}}
+			if _, err := cert.Verify(opts); err != nil {
+				return "", errors.Wrap(errUntrusted, err.Error())
+			}
+		}
+		identity = cert.Subject.CommonName
+	default:
+		return "", errors.WithStack(errUntrusted)
+	}
+
+	if !ed25519.Verify(pub, digest, sig) {
+		return "", errors.WithStack(errBadSignature)
+	}
+
+	if identity == "" {
+		fp := sha256.Sum256(pub)
+		identity = hex.EncodeToString(fp[:8])
+	}
+	return identity, nil
+}
+
+// splitCredential splits a length-prefixed credential from the signature following it
+func splitCredential(msg []byte) (cred []byte, sig []byte, err error) {
+	if len(msg) < 2 {
+		return nil, nil, errors.New("malformed handshake message")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	if len(msg) != 2+n+ed25519.SignatureSize {
+		return nil, nil, errors.New("malformed handshake message")
+	}
+	return msg[2 : 2+n], msg[2+n:], nil
+}
+
+// writeFrame writes a 2-bytes length prefixed frame
+func writeFrame(w io.Writer, p []byte) error {
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return errors.WithStack(err)
+}
+
+// readFrame reads a 2-bytes length prefixed frame
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	p := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// SecureConn is a net.Conn wrapper that encrypts and authenticates data
+// in records with the keys agreed in the handshake
+type SecureConn struct {
+	net.Conn
+	identity string
+
+	wmu    sync.Mutex
+	aeadW  cipherAEAD
+	nonceW uint64
+	wbuf   []byte
+
+	rmu    sync.Mutex
+	aeadR  cipherAEAD
+	nonceR uint64
+	rbuf   []byte // decrypted data not yet read
+	rframe []byte
+}
+
+type cipherAEAD interface {
+	NonceSize() int
+	Overhead() int
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+func newSecureConn(conn net.Conn, secret []byte, salt []byte, client bool, identity string) (*SecureConn, error) {
+	kdf := hkdf.New(sha256.New, secret, salt, []byte("kcptun auth v1"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := new(SecureConn)
+	c.Conn = conn
+	c.identity = identity
+	c.aeadW = aead
+	c.aeadR = aead
+	// both directions share the key, the highest bit of the nonce
+	// tells the direction apart
+	if client {
+		c.nonceW = 1 << 63
+	} else {
+		c.nonceR = 1 << 63
+	}
+	c.wbuf = make([]byte, 2+maxRecordSize+aead.Overhead())
+	c.rframe = make([]byte, maxRecordSize+aead.Overhead())
+	return c, nil
+}
+
+// Identity returns the identity of the authenticated peer, which is the
+// common name of its certificate, or the fingerprint of its public key.
+func (c *SecureConn) Identity() string { return c.identity }
+
+func (c *SecureConn) Read(p []byte) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rbuf) == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		sz := int(binary.BigEndian.Uint16(hdr[:]))
+		if sz > len(c.rframe) {
+			return 0, errors.New("oversized record")
+		}
+		if _, err := io.ReadFull(c.Conn, c.rframe[:sz]); err != nil {
+			return 0, err
+		}
+
+		var nonce [chacha20poly1305.NonceSize]byte
+		binary.BigEndian.PutUint64(nonce[4:], c.nonceR)
+		c.nonceR++
+		if c.rbuf, err = c.aeadR.Open(c.rframe[:0], nonce[:], c.rframe[:sz], nil); err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+
+	n = copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *SecureConn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for len(p) > 0 {
+		sz := min(len(p), maxRecordSize)
+		var nonce [chacha20poly1305.NonceSize]byte
+		binary.BigEndian.PutUint64(nonce[4:], c.nonceW)
+		c.nonceW++
+
+		record := c.aeadW.Seal(c.wbuf[2:2], nonce[:], p[:sz], nil)
+		binary.BigEndian.PutUint16(c.wbuf, uint16(len(record)))
+		if _, err := c.Conn.Write(c.wbuf[:2+len(record)]); err != nil {
+			return n, err
+		}
+		n += sz
+		p = p[sz:]
+	}
+	return n, nil
+}
@@ -0,0 +1,226 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// writeKey generates an ed25519 key pair in dir, returns the paths of the
+// private key and the public key
+func writeKey(t *testing.T, dir, name string) (ed25519.PrivateKey, string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	der, _ = x509.MarshalPKIXPublicKey(pub)
+	pubFile := filepath.Join(dir, name+".pub")
+	os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	return priv, keyFile, pubFile
+}
+
+func authPair(t *testing.T, client, server *Authenticator) (*SecureConn, *SecureConn, error, error) {
+	p1, p2 := net.Pipe()
+	var sconn *SecureConn
+	var serr error
+	done := make(chan struct{})
+	go func() {
+		sconn, serr = server.Server(p2)
+		close(done)
+	}()
+	cconn, cerr := client.Client(p1)
+	if cerr != nil {
+		p1.Close()
+	}
+	<-done
+	return cconn, sconn, cerr, serr
+}
+
+func TestAuthPinnedKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, ckey, cpub := writeKey(t, dir, "client")
+	_, skey, spub := writeKey(t, dir, "server")
+	_, _, opub := writeKey(t, dir, "other")
+
+	client, err := NewAuthenticator(ckey, "", spub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAuthenticator(skey, "", cpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cconn, sconn, cerr, serr := authPair(t, client, server)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+
+	// data must survive the record layer in both directions
+	msg := bytes.Repeat([]byte("kcptun"), 10000)
+	go cconn.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(sconn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatal("client to server mismatch", err)
+	}
+	go sconn.Write(msg)
+	if _, err := io.ReadFull(cconn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatal("server to client mismatch", err)
+	}
+
+	// a client unknown to the server must be rejected
+	stranger, err := NewAuthenticator(ckey, "", spub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewAuthenticator(skey, "", opub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, cerr, serr = authPair(t, stranger, server)
+	if cerr == nil || serr == nil {
+		t.Fatal("untrusted client accepted")
+	}
+	if rejected, ok := errors.Cause(cerr).(*AuthRejectedError); !ok || rejected.Status != authUntrusted || !rejected.Verified {
+		t.Fatal("rejection reason:", cerr)
+	}
+
+	// a rejection reason changed on the path is not verified
+	c1, m1 := net.Pipe()
+	m2, s1 := net.Pipe()
+	go io.Copy(m2, m1)
+	go func() {
+		frame, err := readFrame(m2)
+		if err != nil {
+			return
+		}
+		writeFrame(m1, frame)
+		status := make([]byte, 1+authStatusMACSize)
+		if _, err := io.ReadFull(m2, status); err != nil {
+			return
+		}
+		status[0] = authBadSignature
+		m1.Write(status)
+	}()
+	go server.Server(s1)
+	_, cerr = stranger.Client(c1)
+	if rejected, ok := errors.Cause(cerr).(*AuthRejectedError); !ok || rejected.Verified {
+		t.Fatal("forged rejection verified:", cerr)
+	}
+	c1.Close()
+	s1.Close()
+}
+
+func TestAuthCertificates(t *testing.T) {
+	dir := t.TempDir()
+	capriv, _, _ := writeKey(t, dir, "ca")
+	catmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kcptun-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, catmpl, catmpl, capriv.Public(), capriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+
+	issue := func(name string, usage x509.ExtKeyUsage) (string, string) {
+		priv, keyFile, _ := writeKey(t, dir, name)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, priv.Public(), capriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile := filepath.Join(dir, name+".crt")
+		os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+		return keyFile, certFile
+	}
+
+	ckey, ccert := issue("alice", x509.ExtKeyUsageClientAuth)
+	skey, scert := issue("server", x509.ExtKeyUsageServerAuth)
+	client, err := NewAuthenticator(ckey, ccert, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAuthenticator(skey, scert, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cconn, sconn, cerr, serr := authPair(t, client, server)
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	if sconn.Identity() != "alice" || cconn.Identity() != "server" {
+		t.Fatal("unexpected identities:", sconn.Identity(), cconn.Identity())
+	}
+
+	// a client certificate of the same CA can't act as the server
+	mkey, mcert := issue("mallory", x509.ExtKeyUsageClientAuth)
+	mitm, err := NewAuthenticator(mkey, mcert, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, cerr, _ := authPair(t, client, mitm); errors.Cause(cerr) != errUntrusted {
+		t.Fatal("client certificate accepted as the server:", cerr)
+	}
+
+	// nor a server certificate as a client
+	impostor, err := NewAuthenticator(skey, scert, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, serr := authPair(t, impostor, server); errors.Cause(serr) != errUntrusted {
+		t.Fatal("server certificate accepted as a client:", serr)
+	}
+}
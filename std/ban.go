@@ -0,0 +1,156 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"container/list"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of sources tracked by BanList
+	maxBanSources = 65536
+)
+
+// ban metrics, exported at /debug/vars along with pprof
+var banStats = expvar.NewMap("bans")
+
+// BanList tracks the failures and the new sessions of each source IP, and
+// bans the sources exceeding the limits within a window for a while.
+// At most maxBanSources are tracked, the least recently seen source is
+// evicted first, so a flood of spoofed sources costs O(1) per packet, and
+// the banned sources still sending are kept.
+type BanList struct {
+	failLimit  int // failures allowed in a window, 0 to disable
+	churnLimit int // sessions allowed in a window, 0 to disable
+	window     time.Duration
+	duration   time.Duration
+
+	sources map[string]*list.Element
+	lru     *list.List // of *banSource, most recently seen first
+	mu      sync.Mutex
+}
+
+type banSource struct {
+	ip       string
+	since    time.Time // start of the window
+	failures int
+	sessions int
+	until    time.Time // banned until
+}
+
+// NewBanList creates a BanList, window and duration are in seconds
+func NewBanList(failLimit, churnLimit, window, duration int) *BanList {
+	b := new(BanList)
+	b.failLimit = failLimit
+	b.churnLimit = churnLimit
+	b.window = time.Duration(window) * time.Second
+	b.duration = time.Duration(duration) * time.Second
+	b.sources = make(map[string]*list.Element)
+	b.lru = list.New()
+	return b
+}
+
+// Banned returns true if the source of addr is banned
+func (b *BanList) Banned(addr net.Addr) bool {
+	ip := addrIP(addr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elem, ok := b.sources[ip]; ok && time.Now().Before(elem.Value.(*banSource).until) {
+		b.lru.MoveToFront(elem)
+		banStats.Add("dropped", 1)
+		return true
+	}
+	return false
+}
+
+// Fail records a failure of the source of addr, such as a checksum
+// or handshake failure.
+func (b *BanList) Fail(addr net.Addr, reason string) {
+	banStats.Add(reason, 1)
+	if b.failLimit <= 0 {
+		return
+	}
+	b.record(addr, reason, func(src *banSource) bool {
+		src.failures++
+		return src.failures >= b.failLimit
+	})
+}
+
+// Session records a new session from the source of addr
+func (b *BanList) Session(addr net.Addr) {
+	if b.churnLimit <= 0 {
+		return
+	}
+	b.record(addr, "churn", func(src *banSource) bool {
+		src.sessions++
+		return src.sessions > b.churnLimit
+	})
+}
+
+// record updates the source of addr with f, the source is banned if f returns true
+func (b *BanList) record(addr net.Addr, reason string, f func(src *banSource) bool) {
+	ip := addrIP(addr)
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var src *banSource
+	if elem, ok := b.sources[ip]; ok {
+		b.lru.MoveToFront(elem)
+		src = elem.Value.(*banSource)
+	} else {
+		if b.lru.Len() >= maxBanSources {
+			oldest := b.lru.Back()
+			b.lru.Remove(oldest)
+			delete(b.sources, oldest.Value.(*banSource).ip)
+		}
+		src = &banSource{ip: ip, since: now}
+		b.sources[ip] = b.lru.PushFront(src)
+	}
+
+	if now.Before(src.until) { // already banned
+		return
+	}
+	if now.Sub(src.since) > b.window {
+		src.since, src.failures, src.sessions = now, 0, 0
+	}
+	if f(src) {
+		src.until = now.Add(b.duration)
+		src.since, src.failures, src.sessions = src.until, 0, 0
+		banStats.Add("bans", 1)
+		log.Println("ban:", ip, "reason:", reason, "duration:", b.duration)
+	}
+}
+
+// addrIP returns the IP part of addr
+func addrIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
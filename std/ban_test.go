@@ -0,0 +1,50 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBanListBounded(t *testing.T) {
+	b := NewBanList(2, 0, 60, 60)
+	banned := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	b.Fail(banned, "test")
+	b.Fail(banned, "test")
+	if !b.Banned(banned) {
+		t.Fatal("source not banned")
+	}
+
+	// a flood of distinct sources fills the table, the banned source
+	// still sending is kept
+	for i := 0; i < 2*maxBanSources; i++ {
+		b.Fail(&net.UDPAddr{IP: net.IPv4(172, 16+byte(i>>16), byte(i>>8), byte(i)), Port: 1}, "test")
+		if i%1000 == 0 && !b.Banned(banned) {
+			t.Fatal("banned source evicted at", i)
+		}
+	}
+	if len(b.sources) != maxBanSources || b.lru.Len() != maxBanSources {
+		t.Fatal("sources not bounded:", len(b.sources), b.lru.Len())
+	}
+}
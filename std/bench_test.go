@@ -0,0 +1,202 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build bench
+
+// The benchmarks of the packet pipeline, run with:
+//
+//	go test -tags bench -run '^$' -bench . -count 10 ./std | tee new.txt
+//	benchstat old.txt new.txt
+package std
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// the encryption methods of -crypt besides null
+var benchCrypts = []string{"aes", "aes-128", "aes-192", "salsa20", "xchacha20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none"}
+
+func BenchmarkCrypt(b *testing.B) {
+	key := make([]byte, keySize)
+	rand.Read(key)
+	packet := make([]byte, 1400)
+	rand.Read(packet)
+	for _, crypt := range benchCrypts {
+		b.Run(crypt, func(b *testing.B) {
+			block, _ := NewBlockCrypt(crypt, key)
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				block.Encrypt(packet, packet)
+				block.Decrypt(packet, packet)
+			}
+		})
+	}
+}
+
+func BenchmarkHeaderMAC(b *testing.B) {
+	c := NewHeaderMACConn(nil, make([]byte, keySize))
+	packet := make([]byte, 1400)
+	var tag [HeaderMACSize]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.tag(packet, tag[:])
+	}
+}
+
+// BenchmarkClassify measures the dispatch of the packets of remembered
+// peers by the key rotation and legacy kdf demux
+func BenchmarkClassify(b *testing.B) {
+	const peers = 10000
+	classifier := NewCryptClassifier()
+	var block kcp.BlockCrypt
+	for k := 0; k < 3; k++ {
+		key := make([]byte, keySize)
+		rand.Read(key)
+		block, _ = NewBlockCrypt("aes", key)
+		classifier.Add(k, block)
+	}
+
+	// a packet of the last key, as kcp-go sends it
+	packet := make([]byte, 1400)
+	rand.Read(packet)
+	binary.LittleEndian.PutUint32(packet[cryptNonceSize:], crc32.ChecksumIEEE(packet[cryptHeaderSize:]))
+	block.Encrypt(packet, packet)
+
+	addrs := make([]net.Addr, peers)
+	for k := range addrs {
+		addrs[k] = &net.UDPAddr{IP: net.IPv4(10, 0, byte(k>>8), byte(k)), Port: 10000 + k}
+		if classifier.Classify(packet, addrs[k]) != 2 {
+			b.Fatal("packet not classified")
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		classifier.Classify(packet, addrs[i%peers])
+	}
+}
+
+// benchPipe returns a stream of a smux session over kcp on the loopback,
+// echoed by the other side with the same encryption and FEC
+func benchPipe(b *testing.B, crypt string, dataShards, parityShards int) *smux.Stream {
+	key := make([]byte, keySize)
+	rand.Read(key)
+	block, _ := NewBlockCrypt(crypt, key)
+	lis, err := kcp.ListenWithOptions("127.0.0.1:0", block, dataShards, parityShards)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.AcceptKCP()
+			if err != nil {
+				return
+			}
+			benchTune(conn)
+			mux, _ := smux.Server(conn, smux.DefaultConfig())
+			go func() {
+				for {
+					stream, err := mux.AcceptStream()
+					if err != nil {
+						return
+					}
+					go io.Copy(stream, stream)
+				}
+			}()
+		}
+	}()
+
+	conn, err := kcp.DialWithOptions(lis.Addr().String(), block, dataShards, parityShards)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchTune(conn)
+	mux, err := smux.Client(conn, smux.DefaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { mux.Close() })
+	stream, err := mux.OpenStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return stream
+}
+
+// benchTune applies the parameters of the fast3 mode
+func benchTune(conn *kcp.UDPSession) {
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(false)
+	conn.SetNoDelay(1, 10, 2, 1)
+	conn.SetWindowSize(1024, 1024)
+	conn.SetACKNoDelay(false)
+}
+
+func BenchmarkEcho(b *testing.B) {
+	for _, fec := range [][2]int{{0, 0}, {10, 3}} {
+		for _, crypt := range []string{"none", "aes", "salsa20"} {
+			b.Run(fmt.Sprintf("%v-fec%v-%v", crypt, fec[0], fec[1]), func(b *testing.B) {
+				stream := benchPipe(b, crypt, fec[0], fec[1])
+				buf := make([]byte, 64*1024)
+				go func() {
+					for i := 0; i < b.N; i++ {
+						stream.Write(buf)
+					}
+				}()
+				b.SetBytes(int64(len(buf)))
+				b.ResetTimer()
+				rbuf := make([]byte, len(buf))
+				for i := 0; i < b.N; i++ {
+					if _, err := io.ReadFull(stream, rbuf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSmallWrites measures the round trip of keystroke sized writes
+func BenchmarkSmallWrites(b *testing.B) {
+	stream := benchPipe(b, "aes", 0, 0)
+	buf := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// The kinds of control streams. With -control on both sides, the first
+// stream of every session is a control stream starting with a header of
+// its kind, which the server always reads, so the streams of the clients
+// are never guessed from their data or timing, and a client without
+// -control is refused instead of having its data misread.
+const (
+	ControlNone  = 0 // no control on the session
+	ControlPing  = 1 // latency probes, see Ping
+	ControlRelay = 2 // packets relayed to the next hop, see DialRelay
+)
+
+// the header of a control stream is controlMagic followed by the kind
+const controlMagic = "\x00kcptun-ctl\x00"
+
+// OpenControl opens the control stream of mux, which must be the first
+// stream of mux. The stream of ControlNone is closed right away.
+func OpenControl(mux *smux.Session, kind byte) (*smux.Stream, error) {
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := stream.Write(append([]byte(controlMagic), kind)); err != nil {
+		stream.Close()
+		return nil, errors.WithStack(err)
+	}
+	if kind == ControlNone {
+		stream.Close()
+		return nil, nil
+	}
+	return stream, nil
+}
+
+// AcceptControl reads the header of the control stream, the first stream
+// of a session, and returns its kind
+func AcceptControl(stream io.Reader) (byte, error) {
+	hdr := make([]byte, len(controlMagic)+1)
+	if _, err := io.ReadFull(stream, hdr); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if string(hdr[:len(controlMagic)]) != controlMagic {
+		return 0, errors.New("no control stream, the client must be run with -control")
+	}
+	return hdr[len(controlMagic)], nil
+}
@@ -0,0 +1,63 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+func TestControl(t *testing.T) {
+	p1, p2 := net.Pipe()
+	client, _ := smux.Client(p1, smux.DefaultConfig())
+	server, _ := smux.Server(p2, smux.DefaultConfig())
+	defer client.Close()
+	defer server.Close()
+
+	// the kind of every control stream is read back
+	for _, kind := range []byte{ControlNone, ControlRelay} {
+		if _, err := OpenControl(client, kind); err != nil {
+			t.Fatal(err)
+		}
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := AcceptControl(stream); err != nil || got != kind {
+			t.Fatal("kind mismatch:", got, kind, err)
+		}
+	}
+
+	// a client without -control is refused
+	stream, _ := client.OpenStream()
+	go stream.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcceptControl(accepted); err == nil {
+		t.Fatal("ordinary stream accepted as control")
+	}
+}
@@ -24,8 +24,12 @@ package std
 
 import (
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -51,6 +55,11 @@ func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
 
 // Pipe create a general bidirectional pipe between two streams
 func Pipe(alice, bob io.ReadWriteCloser, closeWait int) (errA, errB error) {
+	return pipe(alice, bob, closeWait, nil)
+}
+
+// pipe stops waiting closeWait once expired is closed
+func pipe(alice, bob io.ReadWriteCloser, closeWait int, expired <-chan struct{}) (errA, errB error) {
 	var closed sync.Once
 
 	var wg sync.WaitGroup
@@ -60,7 +69,10 @@ func Pipe(alice, bob io.ReadWriteCloser, closeWait int) (errA, errB error) {
 		// write error directly to the *pointer
 		_, *err = Copy(dst, src)
 		if closeWait > 0 {
-			<-time.After(time.Duration(closeWait) * time.Second)
+			select {
+			case <-time.After(time.Duration(closeWait) * time.Second):
+			case <-expired:
+			}
 		}
 
 		// wg.Done() called
@@ -82,3 +94,93 @@ func Pipe(alice, bob io.ReadWriteCloser, closeWait int) (errA, errB error) {
 
 	return
 }
+
+var (
+	ErrStreamIdle     = errors.New("stream idle timeout")
+	ErrStreamLifetime = errors.New("stream lifetime exceeded")
+)
+
+// CloseReason describes why a stream piped by PipeTimeout was closed, a
+// side closed after its peer is not a reason
+func CloseReason(errA, errB error) string {
+	for _, err := range []error{errA, errB} {
+		if err != nil && errors.Cause(err) != io.EOF && errors.Cause(err) != io.ErrClosedPipe && !errors.Is(err, net.ErrClosed) {
+			return err.Error()
+		}
+	}
+	return "eof"
+}
+
+// activeStream records the time of the last read on a stream
+type activeStream struct {
+	io.ReadWriteCloser
+	active *int64
+}
+
+func (s activeStream) Read(p []byte) (n int, err error) {
+	n, err = s.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(s.active, time.Now().UnixNano())
+	}
+	return
+}
+
+// PipeTimeout is Pipe with both streams closed after idle seconds without
+// data in either direction, or after lifetime seconds since opened, the
+// reason is returned as errA. Zero disables the timeout.
+func PipeTimeout(alice, bob io.ReadWriteCloser, closeWait, idle, lifetime int) (errA, errB error) {
+	if idle <= 0 && lifetime <= 0 {
+		return Pipe(alice, bob, closeWait)
+	}
+
+	active := time.Now().UnixNano()
+	var reason error
+	var reasonOnce sync.Once
+	expired := make(chan struct{})
+	expire := func(err error) {
+		reasonOnce.Do(func() {
+			reason = err
+			close(expired)
+			alice.Close()
+			bob.Close()
+		})
+	}
+
+	die := make(chan struct{})
+	go func() {
+		var chIdle, chLifetime <-chan time.Time
+		if idle > 0 {
+			ticker := time.NewTicker(time.Duration(idle) * time.Second / 4)
+			defer ticker.Stop()
+			chIdle = ticker.C
+		}
+		if lifetime > 0 {
+			timer := time.NewTimer(time.Duration(lifetime) * time.Second)
+			defer timer.Stop()
+			chLifetime = timer.C
+		}
+
+		for {
+			select {
+			case <-chIdle:
+				if time.Since(time.Unix(0, atomic.LoadInt64(&active))) > time.Duration(idle)*time.Second {
+					expire(ErrStreamIdle)
+					return
+				}
+			case <-chLifetime:
+				expire(ErrStreamLifetime)
+				return
+			case <-die:
+				return
+			}
+		}
+	}()
+
+	errA, errB = pipe(activeStream{alice, &active}, activeStream{bob, &active}, closeWait, expired)
+	close(die)
+	reasonOnce.Do(func() {})
+	if reason != nil { // the errors of closing are expected
+		errA, errB = reason, nil
+	}
+	return
+}
@@ -0,0 +1,262 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tjfoc/gmsm/sm3"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// SALT is the default salt for key expansion
+	SALT = "kcp-go"
+
+	// KDF versions
+	KDFPBKDF2   = "pbkdf2"     // v1, PBKDF2-SHA1 with 4096 iterations
+	KDFArgon2id = "argon2id"   // v2, Argon2id with a per-deployment salt
+	KDFSM3      = "pbkdf2-sm3" // PBKDF2-HMAC-SM3 with 4096 iterations, for regulated environments
+
+	// argon2id parameters, the memory is released after key derivation
+	argon2Time    = 3
+	argon2Memory  = 32 * 1024 // KiB
+	argon2Threads = 4
+
+	// the size of the derived key
+	keySize = 32
+)
+
+const (
+	// kcp-go crypto header: 16-bytes nonce and 4-bytes crc32
+	cryptNonceSize  = 16
+	cryptHeaderSize = cryptNonceSize + 4
+
+	// maximum number of peers remembered by the classifier
+	maxClassifiedPeers = 65536
+
+	// a peer silent for classifiedPeerIdle is classified again, the
+	// smux keepalives of a live session are well within
+	classifiedPeerIdle = 30 * time.Second
+)
+
+// DeriveKey expands the pre-shared secret into a 32-bytes key with the given kdf
+func DeriveKey(kdf string, key string, salt string) ([]byte, error) {
+	if salt == "" {
+		salt = SALT
+	}
+
+	switch kdf {
+	case "", KDFPBKDF2:
+		return pbkdf2.Key([]byte(key), []byte(salt), 4096, keySize, sha1.New), nil
+	case KDFSM3:
+		return pbkdf2.Key([]byte(key), []byte(salt), 4096, keySize, sm3.New), nil
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(key), []byte(salt), argon2Time, argon2Memory, argon2Threads, keySize), nil
+	}
+	return nil, errors.Errorf("unsupported kdf: %v", kdf)
+}
+
+// NewBlockCrypt creates the block encryption of the given method with key,
+// the returned name is the method actually used.
+func NewBlockCrypt(crypt string, key []byte) (block kcp.BlockCrypt, name string) {
+	switch crypt {
+	case "null":
+		return nil, crypt
+	case "sm4":
+		block, _ = kcp.NewSM4BlockCrypt(key[:16])
+	case "tea":
+		block, _ = kcp.NewTEABlockCrypt(key[:16])
+	case "xor":
+		block, _ = kcp.NewSimpleXORBlockCrypt(key)
+	case "none":
+		block, _ = kcp.NewNoneBlockCrypt(key)
+	case "aes-128":
+		block, _ = kcp.NewAESBlockCrypt(key[:16])
+	case "aes-192":
+		block, _ = kcp.NewAESBlockCrypt(key[:24])
+	case "blowfish":
+		block, _ = kcp.NewBlowfishBlockCrypt(key)
+	case "twofish":
+		block, _ = kcp.NewTwofishBlockCrypt(key)
+	case "cast5":
+		block, _ = kcp.NewCast5BlockCrypt(key[:16])
+	case "3des":
+		block, _ = kcp.NewTripleDESBlockCrypt(key[:24])
+	case "xtea":
+		block, _ = kcp.NewXTEABlockCrypt(key[:16])
+	case "salsa20":
+		block, _ = kcp.NewSalsa20BlockCrypt(key)
+	case "xchacha20":
+		block = newXChaCha20BlockCrypt(key)
+	default:
+		block, _ = kcp.NewAESBlockCrypt(key)
+		return block, "aes"
+	}
+	return block, crypt
+}
+
+// directionalBlockCrypt encrypts the packets sent and decrypts the packets
+// received with independent keys
+type directionalBlockCrypt struct {
+	send kcp.BlockCrypt
+	recv kcp.BlockCrypt
+}
+
+func (c *directionalBlockCrypt) Encrypt(dst, src []byte) { c.send.Encrypt(dst, src) }
+func (c *directionalBlockCrypt) Decrypt(dst, src []byte) { c.recv.Decrypt(dst, src) }
+
+// NewDirectionalBlockCrypt creates the block encryption of crypt with
+// independent keys for the packets from the client and from the server,
+// which are derived from key by HKDF. It returns nil for the null method.
+func NewDirectionalBlockCrypt(crypt string, key []byte, server bool) kcp.BlockCrypt {
+	c2s, _ := NewBlockCrypt(crypt, hkdfKey(key, "kcptun client to server"))
+	s2c, _ := NewBlockCrypt(crypt, hkdfKey(key, "kcptun server to client"))
+	if c2s == nil {
+		return nil
+	}
+	if server {
+		return &directionalBlockCrypt{send: s2c, recv: c2s}
+	}
+	return &directionalBlockCrypt{send: c2s, recv: s2c}
+}
+
+// CryptClassifier is a PacketDemux classifier which selects the block
+// encryption a packet was encrypted with by trial decryption. The kcp-go
+// packets carry no version of the key, a random nonce comes first, so the
+// key of a new peer is found by the checksum. Peers are then remembered,
+// and their packets are dispatched by address without decryption until
+// they fall silent for classifiedPeerIdle, or are evicted as the least
+// recently seen of maxClassifiedPeers.
+type CryptClassifier struct {
+	mu     sync.Mutex
+	blocks map[int]kcp.BlockCrypt
+	order  []int                    // the indexes of blocks, nil blocks last
+	peers  map[string]*list.Element // of *classifiedPeer
+	lru    *list.List               // most recently seen first
+	buf    []byte
+}
+
+type classifiedPeer struct {
+	addr string
+	idx  int
+	seen time.Time
+}
+
+// NewCryptClassifier creates an empty CryptClassifier
+func NewCryptClassifier() *CryptClassifier {
+	c := new(CryptClassifier)
+	c.blocks = make(map[int]kcp.BlockCrypt)
+	c.peers = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.buf = make([]byte, mtuLimit)
+	return c
+}
+
+// Add classifies the packets encrypted with block to idx
+func (c *CryptClassifier) Add(idx int, block kcp.BlockCrypt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks[idx] = block
+	c.sort()
+}
+
+// Remove stops classifying packets to idx
+func (c *CryptClassifier) Remove(idx int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blocks, idx)
+	c.sort()
+}
+
+// sort orders the trials by index, a nil block verifies any packet so it
+// is tried after the others
+func (c *CryptClassifier) sort() {
+	c.order = c.order[:0]
+	for idx := range c.blocks {
+		c.order = append(c.order, idx)
+	}
+	sort.Slice(c.order, func(i, j int) bool {
+		bi, bj := c.blocks[c.order[i]] == nil, c.blocks[c.order[j]] == nil
+		if bi != bj {
+			return bj
+		}
+		return c.order[i] < c.order[j]
+	})
+}
+
+// Classify returns the index of the block p was encrypted with, or -1 if none
+func (c *CryptClassifier) Classify(p []byte, addr net.Addr) int {
+	if len(p) < cryptHeaderSize || len(p) > len(c.buf) {
+		return -1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key := addr.String()
+	if elem, ok := c.peers[key]; ok {
+		peer := elem.Value.(*classifiedPeer)
+		if _, ok := c.blocks[peer.idx]; ok && now.Sub(peer.seen) < classifiedPeerIdle {
+			peer.seen = now
+			c.lru.MoveToFront(elem)
+			return peer.idx
+		}
+		c.lru.Remove(elem)
+		delete(c.peers, key)
+	}
+
+	for _, idx := range c.order {
+		if c.verify(c.blocks[idx], p) {
+			if c.lru.Len() >= maxClassifiedPeers {
+				oldest := c.lru.Back()
+				c.lru.Remove(oldest)
+				delete(c.peers, oldest.Value.(*classifiedPeer).addr)
+			}
+			c.peers[key] = c.lru.PushFront(&classifiedPeer{addr: key, idx: idx, seen: now})
+			return idx
+		}
+	}
+	return -1
+}
+
+// verify decrypts p with block and checks the crc32, packets without
+// encryption have no checksum to verify
+func (c *CryptClassifier) verify(block kcp.BlockCrypt, p []byte) bool {
+	if block == nil {
+		return true
+	}
+	block.Decrypt(c.buf, p)
+	return crc32.ChecksumIEEE(c.buf[cryptHeaderSize:len(p)]) == binary.LittleEndian.Uint32(c.buf[cryptNonceSize:])
+}
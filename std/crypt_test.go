@@ -0,0 +1,145 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"testing"
+
+	"github.com/tjfoc/gmsm/sm3"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestDeriveKeySM3(t *testing.T) {
+	// GB/T 32905-2016 example 1
+	if sum := hex.EncodeToString(sm3.Sm3Sum([]byte("abc"))); sum != "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0" {
+		t.Fatal("unexpected sm3:", sum)
+	}
+
+	key, err := DeriveKey(KDFSM3, "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, _ := DeriveKey(KDFPBKDF2, "secret", "")
+	if len(key) != keySize || bytes.Equal(key, legacy) {
+		t.Fatal("unexpected key:", hex.EncodeToString(key))
+	}
+}
+
+func TestXChaCha20BlockCrypt(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, name := NewBlockCrypt("xchacha20", key)
+	if name != "xchacha20" {
+		t.Fatal("unexpected method:", name)
+	}
+
+	packet := make([]byte, 1400)
+	rand.Read(packet)
+	encrypted := make([]byte, len(packet))
+	block.Encrypt(encrypted, packet)
+	if !bytes.Equal(encrypted[:cryptNonceSize], packet[:cryptNonceSize]) {
+		t.Fatal("nonce not kept")
+	}
+	if bytes.Equal(encrypted[cryptNonceSize:], packet[cryptNonceSize:]) {
+		t.Fatal("not encrypted")
+	}
+
+	// in place, as kcp-go does
+	block.Decrypt(encrypted, encrypted)
+	if !bytes.Equal(encrypted, packet) {
+		t.Fatal("decrypted packet differs")
+	}
+}
+
+func TestDirectionalBlockCrypt(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	client := NewDirectionalBlockCrypt("aes", key, false)
+	server := NewDirectionalBlockCrypt("aes", key, true)
+
+	packet := make([]byte, 1400)
+	rand.Read(packet)
+	up, down := make([]byte, len(packet)), make([]byte, len(packet))
+	client.Encrypt(up, packet)
+	server.Encrypt(down, packet)
+	if bytes.Equal(up[cryptNonceSize:], down[cryptNonceSize:]) {
+		t.Fatal("same key in both directions")
+	}
+
+	server.Decrypt(up, up)
+	client.Decrypt(down, down)
+	if !bytes.Equal(up, packet) || !bytes.Equal(down, packet) {
+		t.Fatal("decrypted packet differs")
+	}
+}
+
+func TestCryptClassifier(t *testing.T) {
+	classifier := NewCryptClassifier()
+	var blocks []kcp.BlockCrypt
+	for k := 0; k < 2; k++ {
+		key := make([]byte, keySize)
+		rand.Read(key)
+		block, _ := NewBlockCrypt("aes", key)
+		blocks = append(blocks, block)
+	}
+	classifier.Add(0, nil)
+	classifier.Add(1, blocks[0])
+	classifier.Add(2, blocks[1])
+
+	// a packet of each key, as kcp-go sends it
+	packet := func(block kcp.BlockCrypt) []byte {
+		p := make([]byte, 200)
+		rand.Read(p)
+		binary.LittleEndian.PutUint32(p[cryptNonceSize:], crc32.ChecksumIEEE(p[cryptHeaderSize:]))
+		block.Encrypt(p, p)
+		return p
+	}
+
+	// the keys are tried before the null encryption
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	if idx := classifier.Classify(packet(blocks[1]), addr); idx != 2 {
+		t.Fatal("misclassified:", idx)
+	}
+	if idx := classifier.Classify(make([]byte, 200), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}); idx != 0 {
+		t.Fatal("misclassified plaintext:", idx)
+	}
+
+	// the packets of a remembered peer are dispatched by address
+	if idx := classifier.Classify(packet(blocks[0]), addr); idx != 2 {
+		t.Fatal("remembered peer reclassified:", idx)
+	}
+
+	// the peers remembered are bounded
+	for i := 0; i < maxClassifiedPeers+100; i++ {
+		classifier.Classify(packet(blocks[0]), &net.UDPAddr{IP: net.IPv4(172, 16+byte(i>>16), byte(i>>8), byte(i)), Port: 1})
+	}
+	if len(classifier.peers) != maxClassifiedPeers || classifier.lru.Len() != maxClassifiedPeers {
+		t.Fatal("peers not bounded:", len(classifier.peers), classifier.lru.Len())
+	}
+}
@@ -0,0 +1,260 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// maximum packet size
+	mtuLimit = 1500
+
+	// packets queued for each demultiplexed connection
+	demuxBacklog = 1024
+)
+
+type demuxPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// PacketDemux dispatches the packets received from a shared net.PacketConn
+// to multiple virtual connections, the destination of each packet is decided
+// by a classifier, so listeners with different settings can share one socket.
+type PacketDemux struct {
+	conn     net.PacketConn
+	classify func(p []byte, addr net.Addr) int
+	conns    map[int]*demuxConn
+	connsMu  sync.RWMutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+
+	readError     atomic.Value
+	chReadError   chan struct{}
+	readErrorOnce sync.Once
+}
+
+// NewPacketDemux demultiplexes conn, classify returns the index of the
+// virtual connection a packet belongs to, packets classified to a negative
+// index or to a connection not opened are dropped.
+func NewPacketDemux(conn net.PacketConn, classify func(p []byte, addr net.Addr) int) *PacketDemux {
+	d := new(PacketDemux)
+	d.conn = conn
+	d.classify = classify
+	d.conns = make(map[int]*demuxConn)
+	d.die = make(chan struct{})
+	d.chReadError = make(chan struct{})
+	go d.readLoop()
+	return d
+}
+
+// Conn opens the virtual connection of index i, the connection is
+// removed from the demux when closed.
+func (d *PacketDemux) Conn(i int) net.PacketConn {
+	d.connsMu.Lock()
+	defer d.connsMu.Unlock()
+	if c, ok := d.conns[i]; ok {
+		return c
+	}
+
+	c := &demuxConn{demux: d, idx: i, chPackets: make(chan demuxPacket, demuxBacklog), die: make(chan struct{})}
+	d.conns[i] = c
+	return c
+}
+
+// Close closes the underlying connection and all the virtual connections
+func (d *PacketDemux) Close() error {
+	var once bool
+	d.dieOnce.Do(func() {
+		close(d.die)
+		once = true
+	})
+
+	if !once {
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+	return d.conn.Close()
+}
+
+func (d *PacketDemux) readLoop() {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			d.readErrorOnce.Do(func() {
+				d.readError.Store(errors.WithStack(err))
+				close(d.chReadError)
+			})
+			return
+		}
+
+		idx := d.classify(buf[:n], addr)
+		d.connsMu.RLock()
+		c, ok := d.conns[idx]
+		d.connsMu.RUnlock()
+		if idx < 0 || !ok {
+			atomic.AddUint64(&kcp.DefaultSnmp.InCsumErrors, 1)
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf)
+		select {
+		case c.chPackets <- demuxPacket{data, addr}:
+		default: // drop the packet like a full socket buffer
+			atomic.AddUint64(&kcp.DefaultSnmp.InErrs, 1)
+		}
+	}
+}
+
+// demuxConn is a virtual net.PacketConn on PacketDemux
+type demuxConn struct {
+	demux     *PacketDemux
+	idx       int
+	chPackets chan demuxPacket
+	rd        atomic.Value
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (c *demuxConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var timeout <-chan time.Time
+	if deadline, ok := c.rd.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.chPackets:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-timeout:
+		return 0, nil, errors.WithStack(errTimeout)
+	case <-c.demux.chReadError:
+		return 0, nil, c.demux.readError.Load().(error)
+	case <-c.die:
+		return 0, nil, errors.WithStack(io.ErrClosedPipe)
+	case <-c.demux.die:
+		return 0, nil, errors.WithStack(io.ErrClosedPipe)
+	}
+}
+
+func (c *demuxConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.demux.conn.WriteTo(p, addr)
+}
+
+// Close closes the virtual connection only, the underlying connection is
+// closed by PacketDemux.Close
+func (c *demuxConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.demux.connsMu.Lock()
+		delete(c.demux.conns, c.idx)
+		c.demux.connsMu.Unlock()
+	})
+	return nil
+}
+
+func (c *demuxConn) LocalAddr() net.Addr { return c.demux.conn.LocalAddr() }
+
+func (c *demuxConn) SetDeadline(t time.Time) error {
+	c.rd.Store(t)
+	return c.demux.conn.SetWriteDeadline(t)
+}
+
+func (c *demuxConn) SetReadDeadline(t time.Time) error {
+	c.rd.Store(t)
+	return nil
+}
+
+func (c *demuxConn) SetWriteDeadline(t time.Time) error {
+	return c.demux.conn.SetWriteDeadline(t)
+}
+
+func (c *demuxConn) SetReadBuffer(bytes int) error { return setReadBuffer(c.demux.conn, bytes) }
+
+func (c *demuxConn) SetWriteBuffer(bytes int) error { return setWriteBuffer(c.demux.conn, bytes) }
+
+func (c *demuxConn) SetDSCP(dscp int) error { return setDSCP(c.demux.conn, dscp) }
+
+// timeoutError implements net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var (
+	errTimeout          = timeoutError{}
+	errInvalidOperation = errors.New("invalid operation")
+)
+
+// setReadBuffer sets the socket read buffer of conn if supported
+func setReadBuffer(conn net.PacketConn, bytes int) error {
+	if nc, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// setWriteBuffer sets the socket write buffer of conn if supported
+func setWriteBuffer(conn net.PacketConn, bytes int) error {
+	if nc, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errInvalidOperation
+}
+
+// setDSCP sets the DSCP field of conn in the same way as kcp-go
+func setDSCP(conn net.PacketConn, dscp int) error {
+	if ts, ok := conn.(interface{ SetDSCP(int) error }); ok {
+		return ts.SetDSCP(dscp)
+	}
+
+	if nc, ok := conn.(net.Conn); ok {
+		var succeed bool
+		if err := ipv4.NewConn(nc).SetTOS(dscp << 2); err == nil {
+			succeed = true
+		}
+		if err := ipv6.NewConn(nc).SetTrafficClass(dscp); err == nil {
+			succeed = true
+		}
+
+		if succeed {
+			return nil
+		}
+	}
+	return errInvalidOperation
+}
@@ -0,0 +1,108 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestCryptDemux(t *testing.T) {
+	keyA, err := DeriveKey(KDFArgon2id, "secret", "deployment-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := DeriveKey(KDFPBKDF2, "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA, _ := NewBlockCrypt("aes", keyA)
+	blockB, _ := NewBlockCrypt("aes", keyB)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := []kcp.BlockCrypt{blockA, blockB}
+	classifier := NewCryptClassifier()
+	demux := NewPacketDemux(conn, classifier.Classify)
+	defer demux.Close()
+
+	// echo server for each key
+	for k := range blocks {
+		classifier.Add(k, blocks[k])
+		lis, err := kcp.ServeConn(blocks[k], 0, 0, demux.Conn(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		go func() {
+			for {
+				s, err := lis.AcceptKCP()
+				if err != nil {
+					return
+				}
+				go io.Copy(s, s)
+			}
+		}()
+	}
+
+	// clients with either key must be served
+	for k := range blocks {
+		sess, err := kcp.DialWithOptions(conn.LocalAddr().String(), blocks[k], 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("hello")
+		if _, err := sess.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(sess, buf); err != nil {
+			t.Fatal("key", k, err)
+		}
+		if string(buf) != string(msg) {
+			t.Fatal("key", k, "echo mismatch:", string(buf))
+		}
+		sess.Close()
+	}
+
+	// clients with an unknown key must be dropped
+	keyC, _ := DeriveKey(KDFPBKDF2, "wrong", "")
+	blockC, _ := NewBlockCrypt("aes", keyC)
+	sess, err := kcp.DialWithOptions(conn.LocalAddr().String(), blockC, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	sess.Write([]byte("hello"))
+	sess.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := sess.Read(make([]byte, 5)); err == nil {
+		t.Fatal("unexpected reply to unknown key")
+	}
+}
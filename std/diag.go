@@ -0,0 +1,183 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// diagSession is a live session in the diagnostic snapshot
+type diagSession struct {
+	pool   string
+	conn   *kcp.UDPSession
+	mux    *smux.Session
+	sndwnd int64 // updated by AutoTune
+	rcvwnd int64
+	since  time.Time
+	ping   int64 // the last round trip time measured by Ping
+}
+
+var (
+	diagSessions   = make(map[*smux.Session]*diagSession)
+	diagSessionsMu sync.Mutex
+	diagFile       string
+)
+
+func init() {
+	// served along with pprof
+	http.HandleFunc("/debug/kcptun", func(w http.ResponseWriter, r *http.Request) {
+		DiagDump(w)
+	})
+
+	// the round trip time of the pinged sessions in milliseconds
+	expvar.Publish("ping", expvar.Func(func() interface{} {
+		rtts := make(map[string]float64)
+		diagSessionsMu.Lock()
+		defer diagSessionsMu.Unlock()
+		for _, s := range diagSessions {
+			if rtt := atomic.LoadInt64(&s.ping); rtt > 0 {
+				rtts[fmt.Sprint(s.conn.LocalAddr(), "->", s.conn.RemoteAddr())] = float64(rtt) / float64(time.Millisecond)
+			}
+		}
+		return rtts
+	}))
+
+	// the KCP counters, the same as dumped by SIGUSR1
+	expvar.Publish("snmp", expvar.Func(func() interface{} {
+		return kcp.DefaultSnmp.Copy()
+	}))
+}
+
+// TrackSession adds a session of pool to the diagnostic snapshot until mux is closed
+func TrackSession(pool string, conn *kcp.UDPSession, mux *smux.Session, sndwnd, rcvwnd int) {
+	diagSessionsMu.Lock()
+	diagSessions[mux] = &diagSession{pool: pool, conn: conn, mux: mux, sndwnd: int64(sndwnd), rcvwnd: int64(rcvwnd), since: time.Now()}
+	diagSessionsMu.Unlock()
+
+	go func() {
+		<-mux.CloseChan()
+		diagSessionsMu.Lock()
+		delete(diagSessions, mux)
+		diagSessionsMu.Unlock()
+	}()
+}
+
+// setSessionWindow records the windows of a tracked session
+func setSessionWindow(mux *smux.Session, sndwnd, rcvwnd int) {
+	diagSessionsMu.Lock()
+	defer diagSessionsMu.Unlock()
+	if s, ok := diagSessions[mux]; ok {
+		atomic.StoreInt64(&s.sndwnd, int64(sndwnd))
+		atomic.StoreInt64(&s.rcvwnd, int64(rcvwnd))
+	}
+}
+
+// setSessionPing records the round trip time of a tracked session
+func setSessionPing(mux *smux.Session, rtt time.Duration) {
+	diagSessionsMu.Lock()
+	defer diagSessionsMu.Unlock()
+	if s, ok := diagSessions[mux]; ok {
+		atomic.StoreInt64(&s.ping, int64(rtt))
+	}
+}
+
+// SetDiagFile sets the file the diagnostic snapshots are appended to on
+// SIGUSR1, the snapshots are written to the log if path is empty.
+func SetDiagFile(path string) { diagFile = path }
+
+// DiagDump writes a diagnostic snapshot to w
+func DiagDump(w io.Writer) {
+	fmt.Fprintln(w, "kcptun diagnostics:", time.Now().Format(time.RFC3339))
+	fmt.Fprintln(w, "goroutines:", runtime.NumGoroutine())
+	fmt.Fprintf(w, "KCP SNMP:%+v\n", kcp.DefaultSnmp.Copy())
+	fmt.Fprintln(w, "header mac drops:", HeaderMACDrops())
+	portStats.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintln(w, "port:", kv.Key, "packets:", kv.Value)
+	})
+
+	diagSessionsMu.Lock()
+	sessions := make([]*diagSession, 0, len(diagSessions))
+	for _, s := range diagSessions {
+		sessions = append(sessions, s)
+	}
+	diagSessionsMu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].pool != sessions[j].pool {
+			return sessions[i].pool < sessions[j].pool
+		}
+		return sessions[i].since.Before(sessions[j].since)
+	})
+
+	pools := make(map[string][2]int) // sessions, streams
+	var names []string
+	for _, s := range sessions {
+		p, ok := pools[s.pool]
+		if !ok {
+			names = append(names, s.pool)
+		}
+		pools[s.pool] = [2]int{p[0] + 1, p[1] + s.mux.NumStreams()}
+	}
+	for _, name := range names {
+		fmt.Fprintln(w, "pool:", name, "sessions:", pools[name][0], "streams:", pools[name][1])
+	}
+
+	for _, s := range sessions {
+		fmt.Fprintf(w, "session: %v conv:%v %v->%v srtt:%vms srttvar:%vms rto:%vms ping:%v sndwnd:%v rcvwnd:%v streams:%v closed:%v age:%v\n",
+			s.pool, s.conn.GetConv(), s.conn.LocalAddr(), s.conn.RemoteAddr(),
+			s.conn.GetSRTT(), s.conn.GetSRTTVar(), s.conn.GetRTO(), time.Duration(atomic.LoadInt64(&s.ping)), atomic.LoadInt64(&s.sndwnd), atomic.LoadInt64(&s.rcvwnd),
+			s.mux.NumStreams(), s.mux.IsClosed(), time.Since(s.since).Truncate(time.Second))
+	}
+}
+
+// diagSignal writes a diagnostic snapshot to the diagnostic file or the log
+func diagSignal() {
+	var buf bytes.Buffer
+	DiagDump(&buf)
+	if diagFile == "" {
+		log.Print(buf.String())
+		return
+	}
+
+	f, err := os.OpenFile(diagFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	f.Write(buf.Bytes())
+	log.Println("diagnostics written to:", diagFile)
+}
@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// IP family modes
+const (
+	IPFamilyDefault    = ""            // system default
+	IPFamilyDual       = "dual"        // both families, addresses raced in system order
+	IPFamilyIPv4       = "ipv4"        // ipv4 only
+	IPFamilyIPv6       = "ipv6"        // ipv6 only
+	IPFamilyPreferIPv4 = "prefer-ipv4" // both families, ipv4 first
+	IPFamilyPreferIPv6 = "prefer-ipv6" // both families, ipv6 first
+)
+
+// IPNetwork returns the network of base("udp" or "tcp") restricted by family
+func IPNetwork(base string, family string) string {
+	switch family {
+	case IPFamilyIPv4:
+		return base + "4"
+	case IPFamilyIPv6:
+		return base + "6"
+	}
+	return base
+}
+
+// IPListenNetworks returns the networks to listen on host for family,
+// both families are listened separately on the unspecified host in dual modes.
+func IPListenNetworks(base string, family string, host string) []string {
+	switch family {
+	case IPFamilyDual, IPFamilyPreferIPv4, IPFamilyPreferIPv6:
+		if host == "" {
+			return []string{base + "4", base + "6"}
+		}
+	}
+	return []string{IPNetwork(base, family)}
+}
+
+// IPFamilyOf returns "ipv4" or "ipv6"
+func IPFamilyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return IPFamilyIPv4
+	}
+	return IPFamilyIPv6
+}
+
+// LookupIPFamily resolves host to the addresses to dial in order, the
+// families are interleaved starting with the preferred one in dual modes.
+func LookupIPFamily(host string, family string) ([]net.IP, error) {
+	if family == IPFamilyDefault || host == "" {
+		addr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if addr.IP == nil {
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+		}
+		return []net.IP{addr.IP}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var first, second []net.IP
+	switch family {
+	case IPFamilyIPv4:
+		first = v4
+	case IPFamilyIPv6:
+		first = v6
+	case IPFamilyPreferIPv4:
+		first, second = v4, v6
+	case IPFamilyPreferIPv6:
+		first, second = v6, v4
+	case IPFamilyDual:
+		first, second = v4, v6
+		if ips[0].To4() == nil {
+			first, second = v6, v4
+		}
+	default:
+		return nil, errors.Errorf("unsupported ip family: %v", family)
+	}
+
+	var result []net.IP
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.Errorf("no %v address for %v", family, host)
+	}
+	return result, nil
+}
+
+// RaceFamilies returns true if ips has addresses of both families
+func RaceFamilies(ips []net.IP) bool {
+	for _, ip := range ips[1:] {
+		if IPFamilyOf(ip) != IPFamilyOf(ips[0]) {
+			return true
+		}
+	}
+	return false
+}
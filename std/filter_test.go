@@ -0,0 +1,52 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFilterConn(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	denied, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer allowed.Close()
+	defer denied.Close()
+
+	conn := NewFilterConn(server, func(addr net.Addr) bool { return addr.String() == allowed.LocalAddr().String() })
+	defer conn.Close()
+	denied.WriteTo([]byte("denied"), server.LocalAddr())
+	allowed.WriteTo([]byte("allowed"), server.LocalAddr())
+
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "allowed" || addr.String() != allowed.LocalAddr().String() {
+		t.Fatal("unexpected packet:", string(buf[:n]), addr, err)
+	}
+}
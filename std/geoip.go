@@ -0,0 +1,124 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maximum number of IPs cached by GeoFilter
+	maxGeoCache = 65536
+)
+
+// GeoFilter admits sources by their countries in a MaxMind format GeoIP
+// database, such as GeoLite2-Country.mmdb.
+type GeoFilter struct {
+	db    *maxminddb.Reader
+	allow map[string]bool // empty to allow all countries not denied
+	deny  map[string]bool
+
+	cache map[string]*list.Element
+	lru   *list.List // of *geoEntry, most recently seen first
+	mu    sync.Mutex
+}
+
+// geoEntry is the cached verdict for an IP
+type geoEntry struct {
+	ip      string
+	allowed bool
+}
+
+// NewGeoFilter opens the database at path, allow and deny are comma
+// separated ISO country codes.
+func NewGeoFilter(path string, allow string, deny string) (*GeoFilter, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	f := new(GeoFilter)
+	f.db = db
+	f.allow = countrySet(allow)
+	f.deny = countrySet(deny)
+	f.cache = make(map[string]*list.Element)
+	f.lru = list.New()
+	return f, nil
+}
+
+// Allowed returns true if the country of addr is admitted, sources not
+// found in the database are admitted only if no allow list is given.
+// The verdicts are cached up to maxGeoCache IPs, evicting the least
+// recently seen.
+func (f *GeoFilter) Allowed(addr net.Addr) bool {
+	host := addrIP(addr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if elem, ok := f.cache[host]; ok {
+		f.lru.MoveToFront(elem)
+		return elem.Value.(*geoEntry).allowed
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	var country string
+	if ip := net.ParseIP(host); ip != nil {
+		if err := f.db.Lookup(ip, &record); err == nil {
+			country = record.Country.ISOCode
+		}
+	}
+
+	allowed := !f.deny[country]
+	if len(f.allow) > 0 {
+		allowed = allowed && f.allow[country]
+	}
+
+	if f.lru.Len() >= maxGeoCache {
+		oldest := f.lru.Back()
+		f.lru.Remove(oldest)
+		delete(f.cache, oldest.Value.(*geoEntry).ip)
+	}
+	f.cache[host] = f.lru.PushFront(&geoEntry{ip: host, allowed: allowed})
+	return allowed
+}
+
+// countrySet parses the comma separated country codes
+func countrySet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			set[code] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,114 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// HeaderMACSize is the size of the tag appended to every packet by
+	// HeaderMACConn, the MTU of the sessions must leave room for it
+	HeaderMACSize = 8
+
+	// the bytes of a packet covered by the tag, the nonce and checksum
+	// of kcp-go for encrypted packets
+	headerMACCovered = cryptHeaderSize
+)
+
+// the packets dropped by all HeaderMACConn for bad tags
+var headerMACDrops uint64
+
+// HeaderMACDrops returns the number of packets dropped for bad header tags
+func HeaderMACDrops() uint64 { return atomic.LoadUint64(&headerMACDrops) }
+
+// HeaderMACConn appends a short tag over the header and the length to the
+// packets sent, and silently drops the received packets without a valid
+// tag, so floods of garbage cost a couple of AES blocks per packet instead
+// of the decryption and FEC decoding of kcp-go.
+type HeaderMACConn struct {
+	net.PacketConn
+	block cipher.Block
+	bufs  sync.Pool
+}
+
+// NewHeaderMACConn wraps conn with the tags keyed by the key derived for
+// the purpose from master, the key the packets are encrypted with.
+func NewHeaderMACConn(conn net.PacketConn, master []byte) *HeaderMACConn {
+	block, _ := aes.NewCipher(hkdfKey(master, "kcptun header mac")[:16])
+	c := &HeaderMACConn{PacketConn: conn, block: block}
+	c.bufs.New = func() interface{} { return make([]byte, 0, 2048) }
+	return c
+}
+
+// tag computes the CBC-MAC of the covered header and the length of p, the
+// messages have a fixed length of 2 blocks
+func (c *HeaderMACConn) tag(p []byte, tag []byte) {
+	var m [2 * aes.BlockSize]byte
+	copy(m[:headerMACCovered], p)
+	binary.BigEndian.PutUint32(m[headerMACCovered:], uint32(len(p)))
+	c.block.Encrypt(m[:aes.BlockSize], m[:aes.BlockSize])
+	subtle.XORBytes(m[aes.BlockSize:], m[aes.BlockSize:], m[:aes.BlockSize])
+	c.block.Encrypt(m[aes.BlockSize:], m[aes.BlockSize:])
+	copy(tag, m[aes.BlockSize:aes.BlockSize+HeaderMACSize])
+}
+
+// ReadFrom returns the next packet with a valid tag
+func (c *HeaderMACConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var tag [HeaderMACSize]byte
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || n < HeaderMACSize {
+			if err != nil {
+				return n, addr, err
+			}
+			atomic.AddUint64(&headerMACDrops, 1)
+			continue
+		}
+		n -= HeaderMACSize
+		c.tag(p[:n], tag[:])
+		if subtle.ConstantTimeCompare(tag[:], p[n:n+HeaderMACSize]) == 1 {
+			return n, addr, nil
+		}
+		atomic.AddUint64(&headerMACDrops, 1)
+	}
+}
+
+// WriteTo sends p with the tag appended
+func (c *HeaderMACConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var tag [HeaderMACSize]byte
+	c.tag(p, tag[:])
+	buf := append(append(c.bufs.Get().([]byte)[:0], p...), tag[:]...)
+	_, err := c.PacketConn.WriteTo(buf, addr)
+	c.bufs.Put(buf[:0])
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,59 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeaderMACConn(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	a, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	b, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer a.Close()
+	defer b.Close()
+	sender := NewHeaderMACConn(a, key)
+	receiver := NewHeaderMACConn(b, key)
+	forger := NewHeaderMACConn(a, []byte("another key"))
+
+	packet := bytes.Repeat([]byte{0x55}, 1000)
+	forger.WriteTo(packet, b.LocalAddr())
+	a.WriteTo(packet, b.LocalAddr()) // untagged
+	sender.WriteTo(packet, b.LocalAddr())
+
+	buf := make([]byte, 2048)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], packet) {
+		t.Fatal("packet differs")
+	}
+	if drops := HeaderMACDrops(); drops != 2 {
+		t.Fatal("drops:", drops)
+	}
+}
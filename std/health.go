@@ -0,0 +1,176 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the period the loss of the tunnel is measured over
+	healthPeriod = 5 * time.Second
+
+	// the retransmitted share of the segments sent above which the
+	// tunnel is degraded
+	healthDegradedLoss = 0.1
+)
+
+// Health is the status of the tunnel reported by ServeHealth
+type Health struct {
+	State    string          `json:"state"` // connected, degraded or down
+	RTT      float64         `json:"rtt"`   // milliseconds, averaged over the sessions
+	Loss     float64         `json:"loss"`  // the retransmitted share of the segments sent
+	Sessions []SessionHealth `json:"sessions"`
+}
+
+// SessionHealth is the status of a live session
+type SessionHealth struct {
+	Remote  string  `json:"remote"`
+	RTT     float64 `json:"rtt"` // the ping if measured, the SRTT of KCP otherwise
+	RTO     uint32  `json:"rto"`
+	Streams int     `json:"streams"`
+	Age     int64   `json:"age"` // seconds
+}
+
+var (
+	// the loss is measured over fixed periods rather than between
+	// requests, from the first request on
+	healthLoss      atomic.Value
+	healthMeterOnce sync.Once
+
+	// 1 if the tunnel is not ready without a live session
+	readySession int32
+)
+
+// SetReadyOnSession makes /readyz fail until a session is established,
+// for the client; the server is ready without sessions.
+func SetReadyOnSession(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&readySession, v)
+}
+
+// ServeHealth serves the health of the tunnel as json on addr, a tcp
+// address or the path of a unix socket, for GUIs and scripts to show the
+// status without parsing the logs, along with the probes of orchestrators
+// at /healthz and /readyz.
+func ServeHealth(addr string) error {
+	network := "tcp"
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		network = "unix"
+		os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	go serveHealth(l)
+	return nil
+}
+
+// serveHealth serves the health of the tunnel on l until it's closed
+func serveHealth(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tunnelHealth(measuredLoss()))
+	})
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	return http.Serve(l, mux)
+}
+
+// measuredLoss returns the retransmitted share of the segments sent over
+// the last period
+func measuredLoss() float64 {
+	healthMeterOnce.Do(func() {
+		healthLoss.Store(float64(0))
+		go func() {
+			meter := NewSnmpMeter()
+			for range time.Tick(healthPeriod) {
+				healthLoss.Store(meter.Rates().RetransRatio)
+			}
+		}()
+	})
+	return healthLoss.Load().(float64)
+}
+
+// healthz answers the liveness probes, the process is alive if it answers
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz answers the readiness probes, the tunnel is not ready if it's
+// degraded, or down if a session is required
+func readyz(w http.ResponseWriter, r *http.Request) {
+	h := tunnelHealth(measuredLoss())
+	if h.State == "degraded" || (h.State == "down" && atomic.LoadInt32(&readySession) == 1) {
+		http.Error(w, h.State, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, h.State)
+}
+
+// tunnelHealth summarizes the tracked sessions
+func tunnelHealth(loss float64) Health {
+	h := Health{State: "down", Loss: loss, Sessions: []SessionHealth{}}
+	diagSessionsMu.Lock()
+	for _, s := range diagSessions {
+		if s.mux.IsClosed() {
+			continue
+		}
+		rtt := float64(s.conn.GetSRTT())
+		if ping := atomic.LoadInt64(&s.ping); ping > 0 {
+			rtt = float64(ping) / float64(time.Millisecond)
+		}
+		h.Sessions = append(h.Sessions, SessionHealth{
+			Remote:  s.conn.RemoteAddr().String(),
+			RTT:     rtt,
+			RTO:     s.conn.GetRTO(),
+			Streams: s.mux.NumStreams(),
+			Age:     int64(time.Since(s.since) / time.Second),
+		})
+		h.RTT += rtt
+	}
+	diagSessionsMu.Unlock()
+
+	if n := len(h.Sessions); n > 0 {
+		h.RTT /= float64(n)
+		h.State = "connected"
+		if loss > healthDegradedLoss {
+			h.State = "degraded"
+		}
+	}
+	return h
+}
@@ -0,0 +1,155 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// events queued for a hook, events are dropped if the hook is too slow
+	hookBacklog = 1024
+
+	// maximum time to run a hook
+	hookTimeout = 10 * time.Second
+)
+
+// HookEvent is delivered to the hooks as json
+type HookEvent struct {
+	Event    string  `json:"event"` // session_open, session_close, stream_open, stream_close
+	Time     int64   `json:"time"`  // unix time
+	Remote   string  `json:"remote"`
+	Identity string  `json:"identity,omitempty"`
+	Stream   uint32  `json:"stream,omitempty"`
+	Target   string  `json:"target,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // seconds
+	BytesIn  int64   `json:"bytes_in,omitempty"`
+	BytesOut int64   `json:"bytes_out,omitempty"`
+}
+
+// Hook delivers events to a webhook or a command in the background, in
+// the order they're fired.
+type Hook struct {
+	target string
+	events chan HookEvent
+}
+
+// NewHook creates a hook to target, a http(s) URL the events are POSTed
+// to, or a command which reads the event from stdin and from the
+// KCPTUN_* environment variables.
+func NewHook(target string) *Hook {
+	h := &Hook{target: target, events: make(chan HookEvent, hookBacklog)}
+	go h.deliver()
+	return h
+}
+
+// Fire queues ev for delivery
+func (h *Hook) Fire(ev HookEvent) {
+	ev.Time = time.Now().Unix()
+	select {
+	case h.events <- ev:
+	default:
+		log.Println("hook: backlog full, event dropped:", ev.Event, ev.Remote)
+	}
+}
+
+func (h *Hook) deliver() {
+	client := &http.Client{Timeout: hookTimeout}
+	for ev := range h.events {
+		body, _ := json.Marshal(ev)
+		body = append(body, '\n')
+		if strings.HasPrefix(h.target, "http://") || strings.HasPrefix(h.target, "https://") {
+			resp, err := client.Post(h.target, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Println("hook:", err)
+				continue
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			continue
+		}
+
+		args := strings.Fields(h.target)
+		if len(args) == 0 {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"KCPTUN_EVENT="+ev.Event,
+			"KCPTUN_REMOTE="+ev.Remote,
+			"KCPTUN_IDENTITY="+ev.Identity,
+		)
+		if err := cmd.Start(); err != nil {
+			log.Println("hook:", err)
+			continue
+		}
+		timer := time.AfterFunc(hookTimeout, func() { cmd.Process.Kill() })
+		if err := cmd.Wait(); err != nil {
+			log.Println("hook:", err)
+		}
+		timer.Stop()
+	}
+}
+
+// CountedConn counts the bytes read from and written to a connection
+type CountedConn struct {
+	net.Conn
+	in  int64
+	out int64
+}
+
+// NewCountedConn wraps conn to count its bytes
+func NewCountedConn(conn net.Conn) *CountedConn {
+	return &CountedConn{Conn: conn}
+}
+
+func (c *CountedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddInt64(&c.in, int64(n))
+	return
+}
+
+func (c *CountedConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddInt64(&c.out, int64(n))
+	return
+}
+
+// BytesIn returns the bytes read
+func (c *CountedConn) BytesIn() int64 { return atomic.LoadInt64(&c.in) }
+
+// BytesOut returns the bytes written
+func (c *CountedConn) BytesOut() int64 { return atomic.LoadInt64(&c.out) }
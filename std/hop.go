@@ -0,0 +1,104 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// PortHopper draws the remote port of each time slot from a sequence
+// derived from the pre-shared secret, the sequence looks random to
+// observers while both sides can tell the port in use.
+type PortHopper struct {
+	key      []byte
+	ports    []uint64
+	interval int64 // seconds
+
+	// port of the last slot
+	slot int64
+	port uint64
+	mu   sync.Mutex
+}
+
+// NewPortHopper creates a PortHopper switching between ports every interval seconds
+func NewPortHopper(secret string, ports []uint64, interval int) *PortHopper {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("kcptun port hopping"))
+	return &PortHopper{key: mac.Sum(nil), ports: ports, interval: int64(interval)}
+}
+
+// Port returns the port of the time slot at t
+func (h *PortHopper) Port(t time.Time) uint64 {
+	slot := t.Unix() / h.interval
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.port != 0 && h.slot == slot {
+		return h.port
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(slot))
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(buf[:])
+	h.slot = slot
+	h.port = h.ports[binary.BigEndian.Uint64(mac.Sum(nil))%uint64(len(h.ports))]
+	return h.port
+}
+
+// HoppingConn is a net.PacketConn sending to the port of the current time
+// slot of a host, the packets from any port of the host are reported as
+// from raddr, so the session is kept across hops.
+type HoppingConn struct {
+	*net.UDPConn
+	raddr  *net.UDPAddr
+	hopper *PortHopper
+}
+
+// NewHoppingConn wraps conn to hop between the ports of raddr's host
+func NewHoppingConn(conn *net.UDPConn, raddr *net.UDPAddr, hopper *PortHopper) *HoppingConn {
+	return &HoppingConn{conn, raddr, hopper}
+}
+
+func (c *HoppingConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.UDPConn.ReadFrom(p)
+		if err != nil {
+			return
+		}
+		if udpaddr, ok := addr.(*net.UDPAddr); ok && udpaddr.IP.Equal(c.raddr.IP) {
+			return n, c.raddr, nil
+		}
+	}
+}
+
+func (c *HoppingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if udpaddr, ok := addr.(*net.UDPAddr); ok && udpaddr.IP.Equal(c.raddr.IP) {
+		addr = &net.UDPAddr{IP: c.raddr.IP, Port: int(c.hopper.Port(time.Now())), Zone: c.raddr.Zone}
+	}
+	return c.UDPConn.WriteTo(p, addr)
+}
@@ -0,0 +1,232 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"container/list"
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	// maximum number of peers remembered by MultiPacketConn
+	maxMultiPeers = 65536
+)
+
+var errUnknownPeer = errors.New("no port known for the peer")
+
+// per-port packet counters, exported at /debug/vars along with pprof
+var portStats = expvar.NewMap("ports")
+
+// MultiPacketConn merges the packet connections on multiple ports into
+// one, so a listener serves all the ports with one session table, and
+// sessions survive their peers switching between the ports. Packets to a
+// peer are sent from the port it used last, the peers are remembered up
+// to maxMultiPeers, evicting the least recently seen.
+type MultiPacketConn struct {
+	conns     []net.PacketConn
+	chPackets chan demuxPacket
+	rd        atomic.Value
+
+	peers   map[string]*list.Element // of *multiPeer
+	lru     *list.List               // most recently seen first
+	peersMu sync.Mutex
+
+	statsIn  []*expvar.Int
+	statsOut []*expvar.Int
+
+	die     chan struct{}
+	dieOnce sync.Once
+
+	readError     atomic.Value
+	chReadError   chan struct{}
+	readErrorOnce sync.Once
+}
+
+// multiPeer is the port a peer used last
+type multiPeer struct {
+	addr string
+	idx  int
+}
+
+// NewMultiPacketConn merges conns, conns must not be empty
+func NewMultiPacketConn(conns []net.PacketConn) *MultiPacketConn {
+	c := new(MultiPacketConn)
+	c.conns = conns
+	c.chPackets = make(chan demuxPacket, demuxBacklog)
+	c.peers = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.die = make(chan struct{})
+	c.chReadError = make(chan struct{})
+	for k := range conns {
+		in, out := new(expvar.Int), new(expvar.Int)
+		portStats.Set(conns[k].LocalAddr().String()+" in", in)
+		portStats.Set(conns[k].LocalAddr().String()+" out", out)
+		c.statsIn = append(c.statsIn, in)
+		c.statsOut = append(c.statsOut, out)
+		go c.readLoop(k)
+	}
+	return c
+}
+
+func (c *MultiPacketConn) readLoop(idx int) {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := c.conns[idx].ReadFrom(buf)
+		if err != nil {
+			c.readErrorOnce.Do(func() {
+				c.readError.Store(errors.WithStack(err))
+				close(c.chReadError)
+			})
+			return
+		}
+		c.statsIn[idx].Add(1)
+
+		c.seen(addr.String(), idx)
+
+		data := make([]byte, n)
+		copy(data, buf)
+		select {
+		case c.chPackets <- demuxPacket{data, addr}:
+		case <-c.die:
+			return
+		default: // drop the packet like a full socket buffer
+			atomic.AddUint64(&kcp.DefaultSnmp.InErrs, 1)
+		}
+	}
+}
+
+// seen records the port of a packet from addr
+func (c *MultiPacketConn) seen(addr string, idx int) {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	if elem, ok := c.peers[addr]; ok {
+		elem.Value.(*multiPeer).idx = idx
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= maxMultiPeers {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.peers, oldest.Value.(*multiPeer).addr)
+	}
+	c.peers[addr] = c.lru.PushFront(&multiPeer{addr: addr, idx: idx})
+}
+
+func (c *MultiPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var timeout <-chan time.Time
+	if deadline, ok := c.rd.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.chPackets:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-timeout:
+		return 0, nil, errors.WithStack(errTimeout)
+	case <-c.chReadError:
+		return 0, nil, c.readError.Load().(error)
+	case <-c.die:
+		return 0, nil, errors.WithStack(io.ErrClosedPipe)
+	}
+}
+
+func (c *MultiPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.peersMu.Lock()
+	elem, ok := c.peers[addr.String()]
+	idx := 0
+	if ok {
+		idx = elem.Value.(*multiPeer).idx
+	}
+	c.peersMu.Unlock()
+	if !ok {
+		return 0, errors.WithStack(errUnknownPeer)
+	}
+	c.statsOut[idx].Add(1)
+	return c.conns[idx].WriteTo(p, addr)
+}
+
+// Close closes all the connections
+func (c *MultiPacketConn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the address of the first connection
+func (c *MultiPacketConn) LocalAddr() net.Addr { return c.conns[0].LocalAddr() }
+
+func (c *MultiPacketConn) SetDeadline(t time.Time) error {
+	c.rd.Store(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *MultiPacketConn) SetReadDeadline(t time.Time) error {
+	c.rd.Store(t)
+	return nil
+}
+
+func (c *MultiPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.each(func(conn net.PacketConn) error { return conn.SetWriteDeadline(t) })
+}
+
+func (c *MultiPacketConn) SetReadBuffer(bytes int) error {
+	return c.each(func(conn net.PacketConn) error { return setReadBuffer(conn, bytes) })
+}
+
+func (c *MultiPacketConn) SetWriteBuffer(bytes int) error {
+	return c.each(func(conn net.PacketConn) error { return setWriteBuffer(conn, bytes) })
+}
+
+func (c *MultiPacketConn) SetDSCP(dscp int) error {
+	return c.each(func(conn net.PacketConn) error { return setDSCP(conn, dscp) })
+}
+
+// each applies f to all the connections, returns the first error
+func (c *MultiPacketConn) each(f func(conn net.PacketConn) error) (err error) {
+	for _, conn := range c.conns {
+		if e := f(conn); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMultiPacketConn(t *testing.T) {
+	var conns []net.PacketConn
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	c := NewMultiPacketConn(conns)
+	defer c.Close()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// replies are sent from the port the peer used last
+	if _, err := c.WriteTo([]byte("x"), peer.LocalAddr()); errors.Cause(err) != errUnknownPeer {
+		t.Fatal("sent to an unknown peer:", err)
+	}
+	peer.WriteTo([]byte("ping"), conns[1].LocalAddr())
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := c.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteTo([]byte("pong"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != conns[1].LocalAddr().String() {
+		t.Fatal("replied from", from, "instead of", conns[1].LocalAddr())
+	}
+}
+
+func TestMultiPacketConnBounded(t *testing.T) {
+	c := &MultiPacketConn{peers: make(map[string]*list.Element), lru: list.New()}
+	c.seen("peer", 1)
+	for i := 1; i < maxMultiPeers; i++ {
+		c.seen(fmt.Sprint("flood", i), 0)
+	}
+
+	// a peer seen again outlives the flood filling the table
+	c.seen("peer", 1)
+	c.seen("flood", 0)
+	if c.lru.Len() != maxMultiPeers {
+		t.Fatal("peers not bounded:", c.lru.Len())
+	}
+	if elem, ok := c.peers["peer"]; !ok || elem.Value.(*multiPeer).idx != 1 {
+		t.Fatal("port of a live peer lost")
+	}
+	if _, ok := c.peers["flood1"]; ok {
+		t.Fatal("least recently seen peer not evicted")
+	}
+}
@@ -25,6 +25,7 @@ package std
 import (
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -33,24 +34,33 @@ type MultiPort struct {
 	Host    string
 	MinPort uint64
 	MaxPort uint64
+	Ports   []uint64 // all the ports, in the order specified
 }
 
-// Parse mulitport listener or dialer
+// Parse mulitport listener or dialer, ports are given as a range, or a
+// comma separated list of ports and ranges, like: ":3000-3100,4000"
 func ParseMultiPort(addr string) (*MultiPort, error) {
-	remoteAddrMatcher := regexp.MustCompile(`(.*)\:([0-9]{1,5})-?([0-9]{1,5})?`)
+	remoteAddrMatcher := regexp.MustCompile(`^(.*)\:([0-9]{1,5}(?:-[0-9]{1,5})?(?:,[0-9]{1,5}(?:-[0-9]{1,5})?)*)$`)
 	matches := remoteAddrMatcher.FindStringSubmatch(addr)
+	if len(matches) != 3 {
+		return nil, errors.Errorf("malformed address:%v", addr)
+	}
 
-	if len(matches) >= 4 {
+	mp := new(MultiPort)
+	mp.Host = matches[1]
+	seen := make(map[uint64]bool)
+	for _, item := range strings.Split(matches[2], ",") {
 		var minPort, maxPort int
-		minPort, err := strconv.Atoi(matches[2])
+		bounds := strings.SplitN(item, "-", 2)
+		minPort, err := strconv.Atoi(bounds[0])
 		if err != nil {
 			return nil, err
 		}
 		maxPort = minPort
 
 		// multiport assignment
-		if matches[3] != "" {
-			maxPort, err = strconv.Atoi(matches[3])
+		if len(bounds) == 2 {
+			maxPort, err = strconv.Atoi(bounds[1])
 			if err != nil {
 				return nil, err
 			}
@@ -60,13 +70,22 @@ func ParseMultiPort(addr string) (*MultiPort, error) {
 			return nil, errors.Errorf("invalid port range specified: minport:%v -> maxport %v", minPort, maxPort)
 		}
 
-		mp := new(MultiPort)
-		mp.Host = matches[1]
-		mp.MinPort = uint64(minPort)
-		mp.MaxPort = uint64(maxPort)
-		return mp, nil
+		for port := uint64(minPort); port <= uint64(maxPort); port++ {
+			if !seen[port] {
+				seen[port] = true
+				mp.Ports = append(mp.Ports, port)
+			}
+		}
 	}
 
-	return nil, errors.Errorf("malformed address:%v", addr)
-
+	mp.MinPort, mp.MaxPort = mp.Ports[0], mp.Ports[0]
+	for _, port := range mp.Ports {
+		if port < mp.MinPort {
+			mp.MinPort = port
+		}
+		if port > mp.MaxPort {
+			mp.MaxPort = port
+		}
+	}
+	return mp, nil
 }
@@ -71,3 +71,19 @@ func TestDial(t *testing.T) {
 	}
 
 }
+
+func TestParseMultiPort(t *testing.T) {
+	mp, err := ParseMultiPort("[::1]:3000-3002,4000,3001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.Host != "[::1]" || mp.MinPort != 3000 || mp.MaxPort != 4000 || fmt.Sprint(mp.Ports) != "[3000 3001 3002 4000]" {
+		t.Fatal("unexpected:", mp.Host, mp.MinPort, mp.MaxPort, mp.Ports)
+	}
+
+	for _, addr := range []string{"1.2.3.4", ":0", ":3002-3000", ":3000,", ":70000"} {
+		if _, err := ParseMultiPort(addr); err == nil {
+			t.Fatal("malformed address accepted:", addr)
+		}
+	}
+}
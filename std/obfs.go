@@ -0,0 +1,230 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// the operations requested from the obfuscation plugins
+const (
+	obfsEncode = 'e'
+	obfsDecode = 'd'
+)
+
+// obfsRequest is a packet sent to the plugin awaiting its answer
+type obfsRequest struct {
+	op   byte
+	addr net.Addr
+}
+
+// ObfsConn pipes the packets through an external obfuscation plugin,
+// the packets sent are encoded by the plugin before written to the
+// connection, and the packets received are decoded by it.
+//
+// The plugin reads requests on its stdin, a byte of operation, 'e' to
+// encode or 'd' to decode, the length of the packet in 2 bytes big
+// endian and the packet, and writes for every request, in order, the
+// length of the result in 2 bytes big endian and the result on its
+// stdout. A result of length 0 drops the packet.
+type ObfsConn struct {
+	net.PacketConn
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	pending []obfsRequest
+	mu      sync.Mutex
+	wmu     sync.Mutex
+
+	chPackets chan demuxPacket
+	die       chan struct{}
+	dieOnce   sync.Once
+
+	readError     atomic.Value
+	chReadError   chan struct{}
+	readErrorOnce sync.Once
+}
+
+// NewObfsConn starts the plugin command, a program and its arguments
+// separated by spaces, to obfuscate the packets of conn.
+func NewObfsConn(conn net.PacketConn, command string) (*ObfsConn, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty obfuscation plugin command")
+	}
+
+	c := &ObfsConn{PacketConn: conn}
+	c.cmd = exec.Command(args[0], args[1:]...)
+	c.cmd.Stderr = os.Stderr
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := c.cmd.Start(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.stdin = stdin
+	c.stdout = bufio.NewReader(stdout)
+	c.chPackets = make(chan demuxPacket, demuxBacklog)
+	c.die = make(chan struct{})
+	c.chReadError = make(chan struct{})
+	go c.readLoop()
+	go c.answerLoop()
+	return c, nil
+}
+
+// request sends p to the plugin
+func (c *ObfsConn) request(op byte, p []byte, addr net.Addr) error {
+	if len(p) > 0xffff {
+		return errors.New("packet too large")
+	}
+	frame := make([]byte, 3+len(p))
+	frame[0] = op
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(p)))
+	copy(frame[3:], p)
+
+	// the requests are written in the order they're pending, without
+	// holding mu, so answerLoop never waits on a full stdin
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	c.pending = append(c.pending, obfsRequest{op, addr})
+	c.mu.Unlock()
+	if _, err := c.stdin.Write(frame); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readLoop sends the packets received to the plugin to decode
+func (c *ObfsConn) readLoop() {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err == nil {
+			err = c.request(obfsDecode, buf[:n], addr)
+		}
+		if err != nil {
+			c.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// answerLoop writes the packets encoded by the plugin, and queues the
+// packets decoded for ReadFrom
+func (c *ObfsConn) answerLoop() {
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(c.stdout, size[:]); err != nil {
+			c.notifyReadError(errors.Wrap(err, "obfuscation plugin"))
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(c.stdout, data); err != nil {
+			c.notifyReadError(errors.Wrap(err, "obfuscation plugin"))
+			return
+		}
+
+		c.mu.Lock()
+		req := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		if len(data) == 0 {
+			continue
+		}
+
+		if req.op == obfsEncode {
+			c.PacketConn.WriteTo(data, req.addr)
+			continue
+		}
+		select {
+		case c.chPackets <- demuxPacket{data, req.addr}:
+		default: // drop the packet like a full socket buffer
+		}
+	}
+}
+
+func (c *ObfsConn) notifyReadError(err error) {
+	c.readErrorOnce.Do(func() {
+		c.readError.Store(errors.WithStack(err))
+		close(c.chReadError)
+	})
+}
+
+// ReadFrom returns the next packet decoded by the plugin
+func (c *ObfsConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.chPackets:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.chReadError:
+		return 0, nil, c.readError.Load().(error)
+	case <-c.die:
+		return 0, nil, errors.WithStack(io.ErrClosedPipe)
+	}
+}
+
+// WriteTo sends p to the plugin to encode, the result is written to addr
+func (c *ObfsConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.die:
+		return 0, errors.WithStack(io.ErrClosedPipe)
+	default:
+	}
+	if err := c.request(obfsEncode, p, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close stops the plugin and closes the connection
+func (c *ObfsConn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(io.ErrClosedPipe)
+	}
+
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	go c.cmd.Wait()
+	return c.PacketConn.Close()
+}
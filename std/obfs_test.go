@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestObfsPluginProcess is not a test, it's the plugin run by
+// TestObfsConn, which XORs the packets with 0x5a
+func TestObfsPluginProcess(t *testing.T) {
+	if os.Getenv("KCPTUN_OBFS_PLUGIN") != "1" {
+		return
+	}
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	var head [3]byte
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			os.Exit(0)
+		}
+		p := make([]byte, binary.BigEndian.Uint16(head[1:]))
+		io.ReadFull(r, p)
+		for i := range p {
+			p[i] ^= 0x5a
+		}
+		w.Write(head[1:])
+		w.Write(p)
+		w.Flush()
+	}
+}
+
+func TestObfsConn(t *testing.T) {
+	os.Setenv("KCPTUN_OBFS_PLUGIN", "1")
+	defer os.Unsetenv("KCPTUN_OBFS_PLUGIN")
+	plugin := os.Args[0] + " -test.run=TestObfsPluginProcess"
+
+	a, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	b, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	sender, err := NewObfsConn(a, plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := NewObfsConn(b, plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	packet := bytes.Repeat([]byte("kcptun"), 100)
+	for i := 0; i < 10; i++ {
+		if _, err := sender.WriteTo(packet, b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 2048)
+	for i := 0; i < 10; i++ {
+		n, addr, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], packet) || addr.String() != a.LocalAddr().String() {
+			t.Fatal("packet differs")
+		}
+	}
+}
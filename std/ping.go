@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// a session is considered dead after pingLost probes unanswered
+const pingLost = 3
+
+// the muxes with a ping stream open
+var pinged sync.Map
+
+// Ping keeps probing the server of mux every interval over a dedicated
+// stream, the round trip time measured at the application level is shown
+// in the diagnostics, and the probes also keep the NAT mappings of an idle
+// session warm. The session is closed if the probes are no longer echoed,
+// so that the client can fail over to a new session. The ping stream is
+// the control stream of mux, the probes are sent in the background.
+func Ping(mux *smux.Session, interval time.Duration) {
+	stream, err := OpenControl(mux, ControlPing)
+	if err != nil {
+		return
+	}
+	pinged.Store(mux, stream)
+	go ping(mux, stream, interval)
+}
+
+func ping(mux *smux.Session, stream *smux.Stream, interval time.Duration) {
+	defer stream.Close()
+	defer pinged.Delete(mux)
+	// the server acknowledges the ping stream with a zero byte
+	ack := make([]byte, 1)
+	stream.SetReadDeadline(time.Now().Add(pingLost * interval))
+	if _, err := io.ReadFull(stream, ack); err != nil || ack[0] != 0 {
+		if !mux.IsClosed() {
+			log.Println("ping: not supported by the server on connection:", mux.RemoteAddr())
+		}
+		return
+	}
+
+	base := time.Now()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		probe := make([]byte, 8)
+		for {
+			binary.BigEndian.PutUint64(probe, uint64(time.Since(base)))
+			if _, err := stream.Write(probe); err != nil {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-stream.GetDieCh():
+				return
+			}
+		}
+	}()
+
+	echo := make([]byte, 8)
+	for {
+		stream.SetReadDeadline(time.Now().Add(pingLost * interval))
+		if _, err := io.ReadFull(stream, echo); err != nil {
+			if !mux.IsClosed() {
+				log.Println("ping: lost, closing connection:", mux.RemoteAddr(), err)
+				mux.Close()
+			}
+			return
+		}
+		rtt := time.Since(base) - time.Duration(binary.BigEndian.Uint64(echo))
+		setSessionPing(mux, rtt)
+	}
+}
+
+// NumStreams returns the number of the streams of mux, not counting the
+// ping stream
+func NumStreams(mux *smux.Session) int {
+	n := mux.NumStreams()
+	if _, ok := pinged.Load(mux); ok {
+		n--
+	}
+	return n
+}
+
+// AnswerPing acknowledges the ping stream of a client, and echoes the
+// probes until the stream is closed
+func AnswerPing(stream io.ReadWriteCloser) {
+	defer stream.Close()
+	if _, err := stream.Write([]byte{0}); err != nil {
+		return
+	}
+	io.Copy(stream, stream)
+}
@@ -0,0 +1,91 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestPing(t *testing.T) {
+	p1, p2 := net.Pipe()
+	client, _ := smux.Client(p1, smux.DefaultConfig())
+	server, _ := smux.Server(p2, smux.DefaultConfig())
+	defer client.Close()
+	defer server.Close()
+	TrackSession("test", nil, client, 0, 0)
+
+	// the server answers the ping stream, other streams are echoed
+	go func() {
+		for first := true; ; first = false {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func(first bool) {
+				if first {
+					if kind, err := AcceptControl(stream); err != nil || kind != ControlPing {
+						t.Error("not a ping stream:", kind, err)
+						stream.Close()
+						return
+					}
+					AnswerPing(stream)
+					return
+				}
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}(first)
+		}
+	}()
+
+	Ping(client, 10*time.Millisecond)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello, not a ping")
+	stream.Write(msg)
+	buf := make([]byte, len(msg))
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != string(msg) {
+		t.Fatal("echo mismatch:", string(buf), err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		diagSessionsMu.Lock()
+		rtt := diagSessions[client].ping
+		diagSessionsMu.Unlock()
+		if rtt > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no round trip time measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
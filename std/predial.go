@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// pre-dialing metrics, exported at /debug/vars along with pprof
+var predialStats = expvar.NewMap("predial")
+
+// PreDialer keeps a few connections to a target dialed ahead of the
+// streams, so that new streams don't wait for the handshake with the
+// target. Connections idle for too long are closed and redialed, in
+// case the target times them out.
+type PreDialer struct {
+	dial    func() (net.Conn, error)
+	size    int
+	maxIdle time.Duration
+
+	conns  []predialConn
+	mu     sync.Mutex
+	chFill chan struct{}
+}
+
+type predialConn struct {
+	net.Conn
+	since time.Time
+}
+
+// NewPreDialer keeps size connections made by dial ready, each for at
+// most maxIdle
+func NewPreDialer(dial func() (net.Conn, error), size int, maxIdle time.Duration) *PreDialer {
+	d := new(PreDialer)
+	d.dial = dial
+	d.size = size
+	d.maxIdle = maxIdle
+	d.chFill = make(chan struct{}, 1)
+	go d.fillLoop()
+	return d
+}
+
+// Dial returns a connection dialed ahead if available, or dials one
+func (d *PreDialer) Dial() (net.Conn, error) {
+	d.mu.Lock()
+	n := len(d.conns)
+	var c predialConn
+	if n > 0 { // the freshest
+		c = d.conns[n-1]
+		d.conns = d.conns[:n-1]
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.chFill <- struct{}{}:
+	default:
+	}
+
+	if n > 0 && time.Since(c.since) < d.maxIdle {
+		predialStats.Add("hits", 1)
+		return c.Conn, nil
+	}
+	if n > 0 {
+		c.Close()
+	}
+	predialStats.Add("misses", 1)
+	return d.dial()
+}
+
+// fillLoop redials the stale connections and those taken by Dial
+func (d *PreDialer) fillLoop() {
+	ticker := time.NewTicker(d.maxIdle / 2)
+	defer ticker.Stop()
+	for {
+		d.mu.Lock()
+		fresh := d.conns[:0]
+		for _, c := range d.conns {
+			if time.Since(c.since) < d.maxIdle {
+				fresh = append(fresh, c)
+			} else {
+				c.Close()
+				predialStats.Add("stale", 1)
+			}
+		}
+		d.conns = fresh
+		missing := d.size - len(d.conns)
+		d.mu.Unlock()
+
+		if missing > 0 {
+			conn, err := d.dial()
+			if err == nil {
+				d.mu.Lock()
+				d.conns = append(d.conns, predialConn{conn, time.Now()})
+				d.mu.Unlock()
+				continue
+			}
+			<-time.After(time.Second) // target down
+			continue
+		}
+
+		select {
+		case <-d.chFill:
+		case <-ticker.C:
+		}
+	}
+}
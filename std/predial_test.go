@@ -0,0 +1,61 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreDialer(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	var dials int32
+	dial := func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", echo.Addr().String())
+	}
+	d := NewPreDialer(dial, 2, 200*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatal("dialed ahead:", n)
+	}
+
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatal("dialed after a hit:", n)
+	}
+
+	// the idle connections are redialed
+	time.Sleep(400 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n < 5 {
+		t.Fatal("dialed after idle:", n)
+	}
+}
@@ -0,0 +1,213 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyDialer dials tcp connections through an upstream SOCKS5 or HTTP
+// CONNECT proxy
+type ProxyDialer struct {
+	scheme string
+	addr   string
+	user   *url.Userinfo
+}
+
+// NewProxyDialer parses a proxy url, socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port, it returns nil for an empty url.
+func NewProxyDialer(rawurl string) (*ProxyDialer, error) {
+	if rawurl == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, errors.Errorf("unsupported proxy scheme: %v", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ProxyDialer{scheme: u.Scheme, addr: u.Host, user: u.User}, nil
+}
+
+// Dial connects to addr through the proxy
+func (d *ProxyDialer) Dial(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if d.scheme == "socks5" {
+		err = d.socks5(conn, addr)
+	} else {
+		err = d.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5 performs the handshake of RFC 1928, with the username and
+// password auth of RFC 1929 if the url has a user
+func (d *ProxyDialer) socks5(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(host) > 255 {
+		return errors.New("socks5: host too long")
+	}
+
+	method := byte(0x00) // no auth
+	if d.user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return errors.WithStack(err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("socks5: no acceptable auth method")
+	}
+
+	if d.user != nil {
+		user := d.user.Username()
+		pass, _ := d.user.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5: credentials too long")
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return errors.WithStack(err)
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: auth failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// ver, rep, rsv, atyp, then the bound address
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if head[1] != 0x00 {
+		return errors.Errorf("socks5: connect failed: %v", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return errors.WithStack(err)
+		}
+		skip = int(n[0])
+	default:
+		return errors.New("socks5: bad address type")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// connect performs a HTTP CONNECT, with basic auth if the url has a user
+func (d *ProxyDialer) connect(conn net.Conn, addr string) error {
+	req := fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n", addr, addr)
+	if d.user != nil {
+		pass, _ := d.user.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(d.user.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// read the response byte by byte, the tunneled data follows it, and
+	// the successful responses to CONNECT have no body
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("proxy: %v", resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader reads at most one byte at a time, so a bufio.Reader on it
+// never reads ahead of what it returns
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
@@ -0,0 +1,171 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// echoServer echoes the connections accepted on a local port
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return l
+}
+
+// socks5Server accepts user:pass and connects to the requested address
+func socks5Server(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(conn, buf[:3]) // ver, nmethods, method
+				conn.Write([]byte{0x05, 0x02})
+				io.ReadFull(conn, buf[:2])
+				user := make([]byte, buf[1])
+				io.ReadFull(conn, user)
+				io.ReadFull(conn, buf[:1])
+				pass := make([]byte, buf[0])
+				io.ReadFull(conn, pass)
+				if string(user) != "user" || string(pass) != "pass" {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+
+				io.ReadFull(conn, buf[:4])
+				ip := make(net.IP, net.IPv4len)
+				io.ReadFull(conn, ip)
+				io.ReadFull(conn, buf[:2])
+				target, err := net.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf)))))
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// connectServer serves HTTP CONNECT
+func connectServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func testProxyEcho(t *testing.T, rawurl, target string) {
+	d, err := NewProxyDialer(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo:", string(buf), err)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	socks := socks5Server(t)
+	defer socks.Close()
+	connect := connectServer(t)
+	defer connect.Close()
+
+	testProxyEcho(t, "socks5://user:pass@"+socks.Addr().String(), echo.Addr().String())
+	testProxyEcho(t, "http://"+connect.Addr().String(), echo.Addr().String())
+
+	d, _ := NewProxyDialer("socks5://user:wrong@" + socks.Addr().String())
+	if _, err := d.Dial(echo.Addr().String()); err == nil {
+		t.Fatal("dialed with a wrong password")
+	}
+	if _, err := NewProxyDialer("ftp://" + socks.Addr().String()); err == nil {
+		t.Fatal("accepted ftp proxy")
+	}
+	if d, err := NewProxyDialer(""); d != nil || err != nil {
+		t.Fatal("empty proxy:", d, err)
+	}
+}
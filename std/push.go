@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// maximum size of a statsd datagram
+const statsdPacketSize = 1400
+
+// MetricsPusher pushes the SNMP counters and the throughput to target
+// every interval seconds, for the deployments which can't be scraped.
+// The target is one of:
+//
+//	statsd://host:port              statsd gauges over UDP
+//	influx://host:port              InfluxDB line protocol over UDP
+//	http://host:port/write?db=NAME  InfluxDB line protocol over HTTP
+func MetricsPusher(target string, role string, interval int) {
+	if target == "" || interval == 0 {
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		log.Println("metricspush:", err)
+		return
+	}
+	hostname, _ := os.Hostname()
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "statsd", "influx":
+		if conn, err = net.Dial("udp", u.Host); err != nil {
+			log.Println("metricspush:", err)
+			return
+		}
+		defer conn.Close()
+	case "http", "https":
+	default:
+		log.Println("metricspush: unsupported target:", target)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	meter := NewSnmpMeter()
+	for range ticker.C {
+		snmp := kcp.DefaultSnmp.Copy()
+		rates := meter.Rates()
+		names := append(snmp.Header(), rates.Header()...)
+		values := append(snmp.ToSlice(), rates.ToSlice()...)
+
+		switch u.Scheme {
+		case "statsd":
+			var buf bytes.Buffer
+			for k := range names {
+				line := fmt.Sprintf("kcptun.%v.%v:%v|g\n", role, names[k], values[k])
+				if buf.Len()+len(line) > statsdPacketSize {
+					conn.Write(buf.Bytes())
+					buf.Reset()
+				}
+				buf.WriteString(line)
+			}
+			conn.Write(buf.Bytes())
+		case "influx":
+			conn.Write(influxLine(role, hostname, names, values))
+		case "http", "https":
+			resp, err := http.Post(target, "text/plain; charset=utf-8", bytes.NewReader(influxLine(role, hostname, names, values)))
+			if err != nil {
+				log.Println("metricspush:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Println("metricspush:", target, resp.Status)
+			}
+		}
+	}
+}
+
+// influxLine formats the metrics in the InfluxDB line protocol
+func influxLine(role, hostname string, names, values []string) []byte {
+	fields := make([]string, len(names))
+	for k := range names {
+		fields[k] = names[k] + "=" + values[k] + "i"
+	}
+	host := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(hostname)
+	return []byte(fmt.Sprintf("kcptun,role=%v,host=%v %v %v\n", role, host, strings.Join(fields, ","), time.Now().UnixNano()))
+}
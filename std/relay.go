@@ -0,0 +1,185 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// maximum time to wait for the server to accept a relay stream
+const relayTimeout = 10 * time.Second
+
+// relayAddr is the address of the next hop behind a relay stream
+type relayAddr string
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return string(a) }
+
+// RelayConn is a net.PacketConn relayed over a stream to the next hop of
+// a chain, the packets are framed with a 2-bytes length.
+type RelayConn struct {
+	stream io.ReadWriteCloser
+	addr   net.Addr
+	laddr  net.Addr
+	wmu    sync.Mutex
+}
+
+// DialRelay asks the server of mux to relay packets to the UDP address
+// raddr, which must be allowed on the server with -relay. The relay stream
+// is the control stream of mux, see OpenControl.
+func DialRelay(mux *smux.Session, raddr string) (*RelayConn, error) {
+	if len(raddr) > 255 {
+		return nil, errors.Errorf("relay address too long: %v", raddr)
+	}
+	stream, err := OpenControl(mux, ControlRelay)
+	if err != nil {
+		return nil, err
+	}
+
+	req := append([]byte{byte(len(raddr))}, raddr...)
+	if _, err := stream.Write(req); err != nil {
+		stream.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	// the server replies 0 if the relay is established
+	status := make([]byte, 1)
+	stream.SetReadDeadline(time.Now().Add(relayTimeout))
+	if _, err := io.ReadFull(stream, status); err != nil || status[0] != 0 {
+		stream.Close()
+		return nil, errors.Errorf("relay to %v refused by %v", raddr, mux.RemoteAddr())
+	}
+	stream.SetReadDeadline(time.Time{})
+	return &RelayConn{stream: stream, addr: relayAddr(raddr), laddr: stream.LocalAddr()}, nil
+}
+
+// RemoteAddr returns the address of the next hop
+func (c *RelayConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *RelayConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, err = readPacket(c.stream, p)
+	return n, c.addr, err
+}
+
+func (c *RelayConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := writePacket(c.stream, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *RelayConn) Close() error                       { return c.stream.Close() }
+func (c *RelayConn) LocalAddr() net.Addr                { return c.laddr }
+func (c *RelayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *RelayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *RelayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// readPacket reads a length framed packet from r into p
+func readPacket(r io.Reader, p []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[:]))
+	if size > len(p) {
+		return 0, errors.Errorf("relay packet too large: %v", size)
+	}
+	return io.ReadFull(r, p[:size])
+}
+
+// writePacket writes p to w with the length frame in a single write
+func writePacket(w io.Writer, p []byte) error {
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ServeRelay relays the packets on stream to the UDP address requested by
+// the client, if it is one of allowed, until either side is closed.
+func ServeRelay(stream io.ReadWriteCloser, allowed []string) error {
+	defer stream.Close()
+
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(stream, size); err != nil {
+		return err
+	}
+	raddr := make([]byte, size[0])
+	if _, err := io.ReadFull(stream, raddr); err != nil {
+		return err
+	}
+
+	var ok bool
+	for _, addr := range allowed {
+		if addr == string(raddr) {
+			ok = true
+		}
+	}
+	if !ok {
+		stream.Write([]byte{1})
+		return errors.Errorf("relay to %s not allowed", raddr)
+	}
+	conn, err := net.Dial("udp", string(raddr))
+	if err != nil {
+		stream.Write([]byte{1})
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	if _, err := stream.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, mtuLimit)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				stream.Close()
+				return
+			}
+			if err := writePacket(stream, buf[:n]); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, mtuLimit)
+	for {
+		n, err := readPacket(stream, buf)
+		if err != nil {
+			return nil
+		}
+		conn.Write(buf[:n])
+	}
+}
@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyRotator derives the key of each epoch from the master key, so both
+// sides switch to the same key at every epoch boundary without signaling,
+// the epochs are counted from the unix time. This is key separation, not
+// rotation of the secret: the keys of all the epochs, past and future, are
+// derived from the master key, so they give no forward secrecy.
+type KeyRotator struct {
+	master []byte
+	crypt  string
+	period int64 // seconds, 0 to disable rotation
+
+	directional bool // keys per direction, see NewDirectionalBlockCrypt
+	server      bool
+}
+
+// NewKeyRotator creates a KeyRotator for the crypt method with period in seconds
+func NewKeyRotator(master []byte, crypt string, period int) *KeyRotator {
+	return &KeyRotator{master: master, crypt: crypt, period: int64(period)}
+}
+
+// SetDirectional makes Block return the block encryptions with keys per
+// direction for the server or the client side
+func (r *KeyRotator) SetDirectional(server bool) {
+	r.directional, r.server = true, server
+}
+
+// Enabled returns true if keys are rotated
+func (r *KeyRotator) Enabled() bool { return r.period > 0 }
+
+// Epoch returns the key epoch at t, always 0 if rotation is disabled
+func (r *KeyRotator) Epoch(t time.Time) int64 {
+	if r.period <= 0 {
+		return 0
+	}
+	return t.Unix() / r.period
+}
+
+// Boundary returns the time when the epoch starts
+func (r *KeyRotator) Boundary(epoch int64) time.Time {
+	return time.Unix(epoch*r.period, 0)
+}
+
+// Block returns the block encryption of the epoch, the master key is used
+// directly if rotation is disabled.
+func (r *KeyRotator) Block(epoch int64) kcp.BlockCrypt {
+	key := r.master
+	if r.period > 0 {
+		key = hkdfKey(r.master, fmt.Sprintf("kcptun key epoch %v", epoch))
+	}
+	if r.directional {
+		return NewDirectionalBlockCrypt(r.crypt, key, r.server)
+	}
+	block, _ := NewBlockCrypt(r.crypt, key)
+	return block
+}
+
+// hkdfKey derives a key for the purpose described by info from master
+func hkdfKey(master []byte, info string) []byte {
+	key := make([]byte, keySize)
+	io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(info)), key)
+	return key
+}
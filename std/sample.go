@@ -0,0 +1,135 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	// the fec header of kcp-go, with the size of data shards
+	fecHeaderSize = 6 + 2
+	fecTypeData   = 0xf1
+	fecTypeParity = 0xf2
+)
+
+// the sampling rate of all the PacketSampler, 1 of every sampleRate
+// packets received is logged, 0 to pause sampling
+var sampleRate uint64
+
+func init() {
+	// served along with pprof, GET returns the rate, POST with n sets it
+	http.HandleFunc("/debug/kcptun/sample", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			n, err := strconv.ParseUint(r.FormValue("n"), 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			SetSampleRate(n)
+		}
+		fmt.Fprintln(w, atomic.LoadUint64(&sampleRate))
+	})
+}
+
+// SetSampleRate logs 1 of every n packets received by the PacketSampler,
+// n of 0 pauses the sampling
+func SetSampleRate(n uint64) { atomic.StoreUint64(&sampleRate, n) }
+
+// PacketSampler logs the metadata of a sample of the packets received on
+// a packet connection: the source, the size, and the conv, cmd and sn of
+// the kcp segment when the packet decrypts with the block, for debugging
+// the demultiplexing in production without full captures.
+type PacketSampler struct {
+	net.PacketConn
+	block kcp.BlockCrypt
+	count uint64
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewPacketSampler samples the packets received on conn, which are
+// encrypted with block
+func NewPacketSampler(conn net.PacketConn, block kcp.BlockCrypt) *PacketSampler {
+	s := &PacketSampler{PacketConn: conn, block: block}
+	s.buf = make([]byte, mtuLimit)
+	return s
+}
+
+// ReadFrom implements net.PacketConn
+func (s *PacketSampler) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = s.PacketConn.ReadFrom(p)
+	if err == nil {
+		if rate := atomic.LoadUint64(&sampleRate); rate > 0 && atomic.AddUint64(&s.count, 1)%rate == 0 {
+			log.Println("sample:", addr, n, s.describe(p[:n]))
+		}
+	}
+	return
+}
+
+// describe decodes the headers of p the way kcp-go does
+func (s *PacketSampler) describe(p []byte) string {
+	if len(p) > len(s.buf) {
+		return "oversize"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.buf[:len(p)]
+	copy(data, p)
+	if s.block != nil {
+		if len(data) < cryptHeaderSize {
+			return "short"
+		}
+		s.block.Decrypt(data, data)
+		if crc32.ChecksumIEEE(data[cryptHeaderSize:]) != binary.LittleEndian.Uint32(data[cryptNonceSize:]) {
+			return "undecryptable"
+		}
+		data = data[cryptHeaderSize:]
+	}
+
+	if len(data) >= 6 {
+		switch binary.LittleEndian.Uint16(data[4:]) {
+		case fecTypeParity:
+			return fmt.Sprint("fec parity seqid:", binary.LittleEndian.Uint32(data))
+		case fecTypeData:
+			data = data[min(len(data), fecHeaderSize):]
+		}
+	}
+
+	if len(data) < kcp.IKCP_OVERHEAD {
+		return "short"
+	}
+	return fmt.Sprint("conv:", binary.LittleEndian.Uint32(data), " cmd:", data[4], " sn:", binary.LittleEndian.Uint32(data[kcp.IKCP_SN_OFFSET:]))
+}
@@ -0,0 +1,54 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package std
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestPacketSamplerDescribe(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	block, _ := NewBlockCrypt("aes", key)
+	s := NewPacketSampler(nil, block)
+
+	// an encrypted fec data shard carrying a push segment
+	packet := make([]byte, cryptHeaderSize+fecHeaderSize+24)
+	seg := packet[cryptHeaderSize:]
+	binary.LittleEndian.PutUint16(seg[4:], fecTypeData)
+	seg = seg[fecHeaderSize:]
+	binary.LittleEndian.PutUint32(seg, 42)
+	seg[4] = 81
+	binary.LittleEndian.PutUint32(seg[12:], 7)
+	binary.LittleEndian.PutUint32(packet[cryptNonceSize:], crc32.ChecksumIEEE(packet[cryptHeaderSize:]))
+	block.Encrypt(packet, packet)
+
+	if d := s.describe(packet); d != "conv:42 cmd:81 sn:7" {
+		t.Fatal("described:", d)
+	}
+
+	other, _ := NewBlockCrypt("aes", []byte("fedcba9876543210fedcba9876543210"))
+	if d := NewPacketSampler(nil, other).describe(packet); d != "undecryptable" {
+		t.Fatal("described:", d)
+	}
+}
@@ -0,0 +1,88 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ResolveSecret returns the secret referenced by ref in source, so secrets
+// don't have to be passed in process arguments or stored in plain config
+// files. The source is explicit, so no secret is ever taken for a
+// reference:
+//
+//	""       ref is the secret itself
+//	env      the environment variable ref
+//	file     the content of the file at ref
+//	fd       the content read from the inherited file descriptor ref
+//	exec     the output of the command ref, e.g. "pass show kcptun"
+//
+// Trailing newlines are removed.
+func ResolveSecret(source, ref string) (string, error) {
+	var secret []byte
+	var err error
+	switch source {
+	case "":
+		return ref, nil
+	case "env":
+		v, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", errors.Errorf("secret: environment variable %v not set", ref)
+		}
+		secret = []byte(v)
+	case "file":
+		secret, err = os.ReadFile(ref)
+	case "fd":
+		fd, perr := strconv.Atoi(ref)
+		if perr != nil {
+			return "", errors.Wrap(perr, "secret")
+		}
+		f := os.NewFile(uintptr(fd), "fd:"+ref)
+		if f == nil {
+			return "", errors.Errorf("secret: invalid file descriptor %v", ref)
+		}
+		defer f.Close()
+		secret, err = io.ReadAll(f)
+	case "exec":
+		args := strings.Fields(ref)
+		if len(args) == 0 {
+			return "", errors.New("secret: empty command")
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		secret, err = cmd.Output()
+	default:
+		return "", errors.Errorf("secret: unknown source %v", source)
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "secret")
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
@@ -0,0 +1,51 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	// a key looking like a reference is the key itself
+	if secret, err := ResolveSecret("", "exec:rm -rf /"); err != nil || secret != "exec:rm -rf /" {
+		t.Fatal("literal key resolved:", secret, err)
+	}
+
+	t.Setenv("KCPTUN_TEST_SECRET", "from env")
+	if secret, err := ResolveSecret("env", "KCPTUN_TEST_SECRET"); err != nil || secret != "from env" {
+		t.Fatal("env:", secret, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("from file\n"), 0600)
+	if secret, err := ResolveSecret("file", path); err != nil || secret != "from file" {
+		t.Fatal("file:", secret, err)
+	}
+
+	if _, err := ResolveSecret("vault", "kcptun"); err == nil {
+		t.Fatal("unknown source accepted")
+	}
+}
@@ -25,14 +25,11 @@
 package std
 
 import (
-	"log"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
-
-	kcp "github.com/xtaci/kcp-go/v5"
 )
 
 const (
@@ -53,7 +50,7 @@ func sigHandler() {
 		sig := <-ch
 		switch sig {
 		case syscall.SIGUSR1:
-			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			diagSignal()
 		case syscall.SIGTERM, syscall.SIGINT:
 			postProcess()
 			signal.Stop(ch)
@@ -0,0 +1,101 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"fmt"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// SnmpRates are the rates of the KCP SNMP counters over an interval
+type SnmpRates struct {
+	Interval time.Duration
+
+	SentRate     float64 // bytes per second from the upper level
+	ReceivedRate float64 // bytes per second to the upper level
+	InPktRate    float64 // packets per second
+	OutPktRate   float64
+
+	RetransRatio     float64 // the retransmitted share of the segments sent
+	FECRecoveryRatio float64 // the share of the packets received recovered by FEC
+}
+
+// Header returns the names of the rates for ToSlice
+func (r SnmpRates) Header() []string {
+	return []string{"SentRate", "ReceivedRate", "InPktRate", "OutPktRate", "RetransRatio", "FECRecoveryRatio"}
+}
+
+// ToSlice returns the rates as strings in the order of Header
+func (r SnmpRates) ToSlice() []string {
+	return []string{
+		fmt.Sprintf("%.0f", r.SentRate), fmt.Sprintf("%.0f", r.ReceivedRate),
+		fmt.Sprintf("%.0f", r.InPktRate), fmt.Sprintf("%.0f", r.OutPktRate),
+		fmt.Sprintf("%.4f", r.RetransRatio), fmt.Sprintf("%.4f", r.FECRecoveryRatio),
+	}
+}
+
+// SnmpMeter computes the rates of kcp.DefaultSnmp between the calls of
+// Rates, a counter going backwards after kcp.DefaultSnmp.Reset() is
+// counted from zero.
+type SnmpMeter struct {
+	last *kcp.Snmp
+	at   time.Time
+}
+
+// NewSnmpMeter creates a meter starting from the current counters
+func NewSnmpMeter() *SnmpMeter {
+	return &SnmpMeter{last: kcp.DefaultSnmp.Copy(), at: time.Now()}
+}
+
+// Rates returns the rates since the previous call, it's not safe for
+// concurrent use.
+func (m *SnmpMeter) Rates() SnmpRates {
+	snmp, now := kcp.DefaultSnmp.Copy(), time.Now()
+	last := m.last
+	r := SnmpRates{Interval: now.Sub(m.at)}
+	m.last, m.at = snmp, now
+
+	delta := func(cur, prev uint64) float64 {
+		if cur < prev { // reset
+			return float64(cur)
+		}
+		return float64(cur - prev)
+	}
+	ratio := func(a, b float64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return a / b
+	}
+
+	seconds := r.Interval.Seconds()
+	r.SentRate = ratio(delta(snmp.BytesSent, last.BytesSent), seconds)
+	r.ReceivedRate = ratio(delta(snmp.BytesReceived, last.BytesReceived), seconds)
+	r.InPktRate = ratio(delta(snmp.InPkts, last.InPkts), seconds)
+	r.OutPktRate = ratio(delta(snmp.OutPkts, last.OutPkts), seconds)
+	r.RetransRatio = ratio(delta(snmp.RetransSegs, last.RetransSegs), delta(snmp.OutSegs, last.OutSegs))
+	r.FECRecoveryRatio = ratio(delta(snmp.FECRecovered, last.FECRecovered), delta(snmp.InPkts, last.InPkts))
+	return r
+}
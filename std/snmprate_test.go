@@ -0,0 +1,54 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+func TestSnmpMeter(t *testing.T) {
+	meter := NewSnmpMeter()
+	atomic.AddUint64(&kcp.DefaultSnmp.OutSegs, 100)
+	atomic.AddUint64(&kcp.DefaultSnmp.RetransSegs, 25)
+	atomic.AddUint64(&kcp.DefaultSnmp.BytesSent, 1000)
+	time.Sleep(100 * time.Millisecond)
+
+	r := meter.Rates()
+	if r.RetransRatio != 0.25 {
+		t.Fatal("retrans ratio:", r.RetransRatio)
+	}
+	if r.SentRate < 1000 || r.SentRate > 1000/r.Interval.Seconds()+1 {
+		t.Fatal("sent rate:", r.SentRate, "over", r.Interval)
+	}
+
+	// the counters after a reset are counted from zero
+	kcp.DefaultSnmp.Reset()
+	atomic.AddUint64(&kcp.DefaultSnmp.OutSegs, 10)
+	if r := meter.Rates(); r.RetransRatio != 0 || r.SentRate != 0 {
+		t.Fatal("unexpected rates after reset:", r)
+	}
+}
@@ -0,0 +1,61 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the smallest buffer chosen by AutoSockBuf, the former default
+	minAutoSockBuf = 4194304
+)
+
+// AutoSockBuf sizes the socket buffers from the windows, a buffer holds
+// twice the larger window of full packets so a burst of the whole window
+// fits while the previous one drains.
+func AutoSockBuf(sndwnd, rcvwnd, mtu int) int {
+	return max(minAutoSockBuf, 2*max(sndwnd, rcvwnd)*mtu)
+}
+
+// SockBufMax returns the largest socket buffer the kernel grants
+// without privileges, or 0 if unknown. Larger buffers are silently capped.
+func SockBufMax() int {
+	limit := 0
+	for _, path := range []string{"/proc/sys/net/core/rmem_max", "/proc/sys/net/core/wmem_max"} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return 0
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return 0
+		}
+		if limit == 0 || n < limit {
+			limit = n
+		}
+	}
+	return limit
+}
@@ -0,0 +1,88 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// the summary of the last period of StatsLogger, exported at /debug/vars
+// along with pprof
+var lastStats atomic.Value
+
+func init() {
+	expvar.Publish("stats", expvar.Func(func() interface{} { return lastStats.Load() }))
+}
+
+// Stats summarizes the tunnel over a period
+type Stats struct {
+	SentRate         float64 `json:"sent"` // bytes per second
+	ReceivedRate     float64 `json:"received"`
+	Sessions         int     `json:"sessions"`
+	Streams          int     `json:"streams"`
+	RetransRatio     float64 `json:"retrans"`
+	FECRecoveryRatio float64 `json:"fec"`
+}
+
+// StatsLogger logs a summary of the throughput, the streams, the
+// retransmissions and the FEC recoveries every interval seconds, to see
+// at a glance whether tuning helped.
+func StatsLogger(interval int) {
+	if interval <= 0 {
+		return
+	}
+	meter := NewSnmpMeter()
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		r := meter.Rates()
+		s := Stats{SentRate: r.SentRate, ReceivedRate: r.ReceivedRate, RetransRatio: r.RetransRatio, FECRecoveryRatio: r.FECRecoveryRatio}
+		diagSessionsMu.Lock()
+		for _, sess := range diagSessions {
+			if !sess.mux.IsClosed() {
+				s.Sessions++
+				s.Streams += sess.mux.NumStreams()
+			}
+		}
+		diagSessionsMu.Unlock()
+
+		lastStats.Store(s)
+		log.Printf("stats: sent:%v/s received:%v/s sessions:%v streams:%v retrans:%.2f%% fec:%.2f%%",
+			humanBytes(s.SentRate), humanBytes(s.ReceivedRate), s.Sessions, s.Streams, 100*s.RetransRatio, 100*s.FECRecoveryRatio)
+	}
+}
+
+// humanBytes formats a byte count with binary units
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%v", n, units[i])
+}
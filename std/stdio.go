@@ -0,0 +1,56 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// StdioConn is a net.Conn on the standard input and output, for running
+// as a ProxyCommand of ssh or alike.
+type StdioConn struct{}
+
+// NewStdioConn creates a net.Conn on stdin and stdout
+func NewStdioConn() *StdioConn { return &StdioConn{} }
+
+func (c *StdioConn) Read(p []byte) (n int, err error)  { return os.Stdin.Read(p) }
+func (c *StdioConn) Write(p []byte) (n int, err error) { return os.Stdout.Write(p) }
+
+// Close closes both stdin and stdout, so the peer process sees EOF
+func (c *StdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+func (c *StdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *StdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *StdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *StdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *StdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
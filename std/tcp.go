@@ -0,0 +1,84 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// TCPOptions are the socket options of the plain TCP legs of the relay,
+// zero values leave the system defaults.
+type TCPOptions struct {
+	NoDelay   bool
+	KeepAlive int // seconds, negative to disable
+	ReadBuf   int // SO_RCVBUF
+	WriteBuf  int // SO_SNDBUF
+	DSCP      int // IP_TOS and IPV6_TCLASS
+}
+
+// Apply sets the options on conn if it's a TCP connection
+func (o TCPOptions) Apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tc.SetNoDelay(o.NoDelay); err != nil {
+		return errors.WithStack(err)
+	}
+	if o.KeepAlive < 0 {
+		if err := tc.SetKeepAlive(false); err != nil {
+			return errors.WithStack(err)
+		}
+	} else if o.KeepAlive > 0 {
+		if err := tc.SetKeepAlive(true); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := tc.SetKeepAlivePeriod(time.Duration(o.KeepAlive) * time.Second); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if o.ReadBuf > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuf); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if o.WriteBuf > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuf); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if o.DSCP > 0 { // either family succeeding is enough, like kcp-go
+		err4 := ipv4.NewConn(tc).SetTOS(o.DSCP << 2)
+		err6 := ipv6.NewConn(tc).SetTrafficClass(o.DSCP << 2)
+		if err4 != nil && err6 != nil {
+			return errors.WithStack(err4)
+		}
+	}
+	return nil
+}
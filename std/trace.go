@@ -0,0 +1,260 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// spans are exported every tracerPeriod, or once tracerBatch spans are ended
+	tracerPeriod = 5 * time.Second
+	tracerBatch  = 512
+
+	// spans dropped if the collector can't keep up
+	tracerBacklog = 8192
+)
+
+// OTLP span kinds
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// Tracer exports spans to an OpenTelemetry collector with OTLP/HTTP in
+// JSON, a nil Tracer traces nothing.
+type Tracer struct {
+	url     string
+	service string
+	mu      sync.Mutex
+	spans   []*Span
+	flush   chan struct{}
+}
+
+// Span is a traced operation, the methods of a nil Span do nothing
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  *Span
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]interface{}
+	mu      sync.Mutex
+}
+
+// NewTracer creates a tracer exporting to the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318, it returns nil if endpoint is empty.
+func NewTracer(endpoint string, service string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &Tracer{url: strings.TrimSuffix(endpoint, "/") + "/v1/traces", service: service, flush: make(chan struct{}, 1)}
+	go t.exportLoop()
+	return t
+}
+
+// Start starts a span of kind, as a child of parent if not nil
+func (t *Tracer) Start(name string, kind int, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, parent: parent, name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent != nil {
+		s.traceID = parent.traceID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Set sets an attribute of the span
+func (s *Span) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetSession sets the attributes of the kcp session under mux
+func (s *Span) SetSession(mux *smux.Session) {
+	if s == nil {
+		return
+	}
+	diagSessionsMu.Lock()
+	ds, ok := diagSessions[mux]
+	diagSessionsMu.Unlock()
+	if !ok || ds.conn == nil {
+		return
+	}
+	s.Set("kcp.conv", ds.conn.GetConv())
+	s.Set("kcp.srtt_ms", int64(ds.conn.GetSRTT()))
+	s.Set("kcp.rto_ms", int64(ds.conn.GetRTO()))
+	if rtt := atomic.LoadInt64(&ds.ping); rtt > 0 {
+		s.Set("kcptun.ping_ms", float64(rtt)/float64(time.Millisecond))
+	}
+	// kcp-go counts the retransmissions of all the sessions only
+	s.Set("kcp.retrans_segs_total", kcp.DefaultSnmp.Copy().RetransSegs)
+}
+
+// End ends the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	t := s.tracer
+	t.mu.Lock()
+	if len(t.spans) < tracerBacklog {
+		t.spans = append(t.spans, s)
+	}
+	n := len(t.spans)
+	t.mu.Unlock()
+	if n >= tracerBatch {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	ticker := time.NewTicker(tracerPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		}
+
+		t.mu.Lock()
+		spans := t.spans
+		t.spans = nil
+		t.mu.Unlock()
+		if len(spans) == 0 {
+			continue
+		}
+
+		resp, err := http.Post(t.url, "application/json", bytes.NewReader(t.encode(spans)))
+		if err != nil {
+			log.Println("otlp:", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Println("otlp:", t.url, resp.Status)
+		}
+	}
+}
+
+// otlpValue is an OTLP AnyValue
+type otlpValue map[string]interface{}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]interface{}) []otlpAttr {
+	out := make([]otlpAttr, 0, len(attrs))
+	for k, v := range attrs {
+		var value otlpValue
+		switch v := v.(type) {
+		case int, int64, uint32, uint64:
+			value = otlpValue{"intValue": fmt.Sprint(v)}
+		case float64:
+			value = otlpValue{"doubleValue": v}
+		case bool:
+			value = otlpValue{"boolValue": v}
+		default:
+			value = otlpValue{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttr{k, value})
+	}
+	return out
+}
+
+// encode encodes spans in the OTLP/JSON format
+func (t *Tracer) encode(spans []*Span) []byte {
+	type otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes"`
+	}
+
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   fmt.Sprint(s.start.UnixNano()),
+			End:     fmt.Sprint(s.end.UnixNano()),
+		}
+		if s.parent != nil {
+			span.ParentSpanID = hex.EncodeToString(s.parent.spanID[:])
+		}
+		s.mu.Lock()
+		span.Attributes = otlpAttrs(s.attrs)
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "kcptun"},
+				"spans": out,
+			}},
+		}},
+	})
+	return data
+}
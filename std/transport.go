@@ -0,0 +1,58 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"strings"
+)
+
+// PacketTransport carries KCP over something else than UDP, selected by
+// the scheme prefixed to the addresses, eg: unixgram:/run/kcptun.sock
+type PacketTransport struct {
+	// Listen returns the packet connection the server serves KCP on
+	Listen func(addr string) (net.PacketConn, error)
+
+	// Dial returns a packet connection for the client, and the address
+	// of the server to send the packets to
+	Dial func(addr string) (net.PacketConn, net.Addr, error)
+}
+
+var transports = make(map[string]PacketTransport)
+
+// RegisterTransport makes t available under scheme, it's not safe to call
+// concurrently with LookupTransport and is meant for init functions.
+func RegisterTransport(scheme string, t PacketTransport) {
+	transports[scheme] = t
+}
+
+// LookupTransport returns the transport of addr by its scheme and the addr
+// without the scheme, ok is false for plain host:port addresses.
+func LookupTransport(addr string) (t PacketTransport, rest string, ok bool) {
+	scheme, rest, found := strings.Cut(addr, ":")
+	if !found {
+		return t, addr, false
+	}
+	t, ok = transports[scheme]
+	return t, rest, ok
+}
@@ -0,0 +1,48 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import "testing"
+
+func TestLookupTransport(t *testing.T) {
+	RegisterTransport("test", PacketTransport{})
+	defer delete(transports, "test")
+
+	tests := []struct {
+		addr string
+		rest string
+		ok   bool
+	}{
+		{"test:/run/kcptun.sock", "/run/kcptun.sock", true},
+		{"unixgram:/run/kcptun.sock", "/run/kcptun.sock", true},
+		{"1.2.3.4:29900", "1.2.3.4:29900", false},
+		{"[::1]:29900", "[::1]:29900", false},
+		{"/run/kcptun.sock", "/run/kcptun.sock", false},
+	}
+	for _, tt := range tests {
+		_, rest, ok := LookupTransport(tt.addr)
+		if ok != tt.ok || ok && rest != tt.rest {
+			t.Errorf("LookupTransport(%q) = %q, %v, want %q, %v", tt.addr, rest, ok, tt.rest, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// the windows are adjusted every tunePeriod
+	tunePeriod = time.Second
+
+	// the send window shrinks once the retransmitted share of the
+	// segments sent exceeds tuneLoss
+	tuneLoss = 0.05
+
+	// a window is window limited if the delivery rate reaches tuneBusy
+	// of the rate it allows in a round trip
+	tuneBusy = 0.7
+)
+
+// sessions being tuned, which share the throughput counted by kcp-go
+var tunedSessions int64
+
+// AutoTune adjusts the send and receive windows of conn between minWnd and
+// maxSnd, maxRcv until mux is closed. The windows grow while they limit the
+// delivery rate, the send window shrinks on loss, and both shrink towards
+// twice the bandwidth-delay product when oversized. kcp-go only counts the
+// throughput and loss of all sessions, which are shared evenly.
+func AutoTune(conn *kcp.UDPSession, mux *smux.Session, mtu, minWnd, maxSnd, maxRcv int) {
+	atomic.AddInt64(&tunedSessions, 1)
+	defer atomic.AddInt64(&tunedSessions, -1)
+
+	snd, rcv := min(minWnd, maxSnd), min(minWnd, maxRcv)
+	conn.SetWindowSize(snd, rcv)
+	setSessionWindow(mux, snd, rcv)
+
+	ticker := time.NewTicker(tunePeriod)
+	defer ticker.Stop()
+	meter := NewSnmpMeter()
+	for {
+		select {
+		case <-mux.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		rates := meter.Rates()
+		n := float64(atomic.LoadInt64(&tunedSessions))
+		sent, received, loss := rates.SentRate/n, rates.ReceivedRate/n, rates.RetransRatio
+
+		// srtt is 0 on loopback
+		srtt := float64(max(conn.GetSRTT(), 1)) / 1000
+		newSnd := tuneWindow(snd, sent, srtt, mtu, minWnd, maxSnd)
+		if loss > tuneLoss {
+			newSnd = max(minWnd, snd*3/4)
+		}
+		newRcv := tuneWindow(rcv, received, srtt, mtu, minWnd, maxRcv)
+		if newSnd != snd || newRcv != rcv {
+			log.Printf("autotune: %v->%v sndwnd:%v rcvwnd:%v srtt:%.0fms loss:%.1f%%", conn.LocalAddr(), conn.RemoteAddr(), newSnd, newRcv, srtt*1000, loss*100)
+			snd, rcv = newSnd, newRcv
+			conn.SetWindowSize(snd, rcv)
+			setSessionWindow(mux, snd, rcv)
+		}
+	}
+}
+
+// tuneWindow returns the window in segments for the delivery rate in bytes
+// per second over a round trip of srtt seconds
+func tuneWindow(wnd int, rate, srtt float64, mtu, minWnd, maxWnd int) int {
+	bdp := int(rate * srtt / float64(mtu))
+	switch {
+	case bdp >= int(float64(wnd)*tuneBusy): // window limited
+		wnd = min(maxWnd, wnd*2)
+	case bdp*4 < wnd: // oversized
+		wnd = max(minWnd, max(bdp*2, wnd*3/4))
+	}
+	return max(min(wnd, maxWnd), min(minWnd, maxWnd))
+}
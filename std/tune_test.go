@@ -0,0 +1,47 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import "testing"
+
+func TestTuneWindow(t *testing.T) {
+	const mtu = 1000
+	tests := []struct {
+		wnd   int
+		rate  float64
+		srtt  float64
+		want  int
+		cause string
+	}{
+		{64, 64 * mtu / 0.1, 0.1, 128, "window limited"},
+		{512, 512 * mtu / 0.1, 0.1, 1024, "capped by max"},
+		{1024, 10 * mtu / 0.1, 0.1, 768, "oversized"},
+		{40, 0, 0.1, 32, "idle"},
+		{256, 150 * mtu / 0.1, 0.1, 256, "steady"},
+	}
+	for _, tt := range tests {
+		if got := tuneWindow(tt.wnd, tt.rate, tt.srtt, mtu, 32, 1024); got != tt.want {
+			t.Errorf("%v: tuneWindow(%v) = %v, want %v", tt.cause, tt.wnd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterTransport("unixgram", PacketTransport{
+		Listen: func(path string) (net.PacketConn, error) {
+			conn, err := ListenUnixgram(path)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+		Dial: func(path string) (net.PacketConn, net.Addr, error) {
+			conn, raddr, err := DialUnixgram(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			return conn, raddr, nil
+		},
+	})
+}
+
+// ListenUnixgram listens on the unix datagram socket at path, the socket
+// left by a previous run is removed first.
+func ListenUnixgram(path string) (*net.UnixConn, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	return conn, errors.WithStack(err)
+}
+
+// DialUnixgram returns a unix datagram socket bound to an autobound
+// abstract address to exchange datagrams with the socket at path
+func DialUnixgram(path string) (*net.UnixConn, *net.UnixAddr, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return conn, &net.UnixAddr{Name: path, Net: "unixgram"}, nil
+}
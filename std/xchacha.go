@@ -0,0 +1,52 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package std
+
+import (
+	"golang.org/x/crypto/chacha20"
+)
+
+// xchacha20BlockCrypt encrypts the packets with XChaCha20 keyed by the
+// random nonce of kcp-go, which is fast without AES-NI. The packets are
+// protected by the checksum of kcp-go like the other methods, as kcp-go
+// can't carry the tag of Poly1305.
+type xchacha20BlockCrypt struct {
+	key [chacha20.KeySize]byte
+}
+
+func newXChaCha20BlockCrypt(key []byte) *xchacha20BlockCrypt {
+	c := new(xchacha20BlockCrypt)
+	copy(c.key[:], key)
+	return c
+}
+
+func (c *xchacha20BlockCrypt) xor(dst, src []byte) {
+	var nonce [chacha20.NonceSizeX]byte
+	copy(nonce[:], src[:cryptNonceSize])
+	s, _ := chacha20.NewUnauthenticatedCipher(c.key[:], nonce[:])
+	s.XORKeyStream(dst[cryptNonceSize:], src[cryptNonceSize:])
+	copy(dst[:cryptNonceSize], src[:cryptNonceSize])
+}
+
+func (c *xchacha20BlockCrypt) Encrypt(dst, src []byte) { c.xor(dst, src) }
+func (c *xchacha20BlockCrypt) Decrypt(dst, src []byte) { c.xor(dst, src) }